@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/bpineau/kube-named-ports/config"
+)
+
+var (
+	configFormat string
+
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+
+	configCheckCmd = &cobra.Command{
+		Use:   "check",
+		Short: "Validate the configuration, and display the effective settings",
+		Long: "Display the effective configuration, merged from flags, environment, configuration file\n" +
+			"and defaults, with the source of each setting, and report the configuration issues\n" +
+			"(unknown keys, wrong types, invalid or inconsistent values).\n" +
+			"Exits with status 2 when the configuration is invalid.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if configFormat != "table" && configFormat != "json" {
+				return fmt.Errorf("Unknown output format %q (should be table or json)", configFormat)
+			}
+
+			report := configReport{
+				File:     viper.ConfigFileUsed(),
+				Settings: effectiveConfig(viper.GetViper()),
+				Errors:   configErrors(viper.GetViper()),
+			}
+
+			if err := printConfigReport(cmd.OutOrStdout(), &report, configFormat); err != nil {
+				return err
+			}
+
+			if len(report.Errors) > 0 {
+				return findingsf("Invalid configuration")
+			}
+
+			return nil
+		},
+	}
+)
+
+// configReport holds the effective configuration, and its issues
+type configReport struct {
+	File     string          `json:"file"`
+	Settings []configSetting `json:"settings"`
+	Errors   []string        `json:"errors"`
+}
+
+// configSetting is an effective configuration value, and where it comes from
+type configSetting struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+func init() {
+	configCheckCmd.Flags().StringVarP(&configFormat, "format", "f", "table", "output format: table or json")
+	configCmd.AddCommand(configCheckCmd)
+	RootCmd.AddCommand(configCmd)
+}
+
+// checkConfig reports unknown keys and malformed values in the configuration file,
+// and values that can't be converted to their setting's type
+func checkConfig(v *viper.Viper) error {
+	if errs := configFileErrors(v); len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// configFileErrors returns the configuration file and settings types issues
+func configFileErrors(v *viper.Viper) []string {
+	var errs []string
+	if file := v.ConfigFileUsed(); file != "" {
+		errs = append(errs, checkConfigFile(file)...)
+	}
+	return append(errs, checkConfigTypes(v)...)
+}
+
+// readConfigFile loads a configuration file alone (without flags, env nor defaults)
+func readConfigFile(file string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+	}
+	return v, nil
+}
+
+// checkConfigFile reports syntax errors and unknown keys in the configuration file
+func checkConfigFile(file string) []string {
+	v, err := readConfigFile(file)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var errs, unknown []string
+	for _, key := range v.AllKeys() {
+		if _, ok := configFlags[key]; !ok && key != "clusters" {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		errs = append(errs, fmt.Sprintf("Unknown keys in %s: %s", file, strings.Join(unknown, ", ")))
+	}
+
+	var clusters []config.ClusterConfig
+	err = v.UnmarshalKey("clusters", &clusters, func(c *mapstructure.DecoderConfig) {
+		c.ErrorUnused = true
+	})
+	if merr, ok := err.(*mapstructure.Error); ok {
+		errs = append(errs, fmt.Sprintf("Invalid clusters list in %s: %s", file, strings.Join(merr.Errors, ", ")))
+	} else if err != nil {
+		errs = append(errs, fmt.Sprintf("Invalid clusters list in %s: %v", file, err))
+	}
+
+	return errs
+}
+
+// checkConfigTypes reports settings values that can't be converted to the setting's type
+func checkConfigTypes(v *viper.Viper) []string {
+	var errs []string
+
+	for _, key := range configKeys() {
+		value := v.Get(key)
+		if value == nil {
+			continue
+		}
+
+		var err error
+		kind := configFlags[key].Value.Type()
+		switch kind {
+		case "int":
+			_, err = cast.ToIntE(value)
+		case "float64":
+			_, err = cast.ToFloat64E(value)
+		case "bool":
+			_, err = cast.ToBoolE(value)
+		case "stringSlice":
+			_, err = cast.ToStringSliceE(value)
+		default:
+			_, err = cast.ToStringE(value)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Invalid %s value %v (expected %s)", key, value, kind))
+		}
+	}
+
+	return errs
+}
+
+// configKeys returns the known configuration keys, sorted
+func configKeys() []string {
+	var keys []string
+	for key := range configFlags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configErrors returns all the configuration issues found
+func configErrors(v *viper.Viper) []string {
+	errs := configFileErrors(v)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	conf, err := newConfig()
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	confs := []*config.KnpConfig{conf}
+	if v.IsSet("clusters") {
+		var clusters []config.ClusterConfig
+		if err = v.UnmarshalKey("clusters", &clusters); err != nil {
+			return []string{fmt.Sprintf("Failed to parse clusters list: %v", err)}
+		}
+
+		confs = nil
+		for _, cl := range clusters {
+			confs = append(confs, conf.ForCluster(cl))
+		}
+	}
+
+	for _, conf := range confs {
+		if err = conf.Validate(); err == nil {
+			continue
+		}
+		if v.IsSet("clusters") {
+			errs = append(errs, fmt.Sprintf("Cluster %q: %v", conf.Cluster, err))
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	return errs
+}
+
+// effectiveConfig returns the settings values, sorted by key
+func effectiveConfig(v *viper.Viper) []configSetting {
+	var file *viper.Viper
+	if v.ConfigFileUsed() != "" {
+		file, _ = readConfigFile(v.ConfigFileUsed())
+	}
+
+	var settings []configSetting
+	for _, key := range configKeys() {
+		settings = append(settings, configSetting{Key: key, Value: v.Get(key), Source: configSource(key, file)})
+	}
+
+	if v.IsSet("clusters") {
+		settings = append(settings, configSetting{Key: "clusters", Value: v.Get("clusters"), Source: "file"})
+		sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	}
+
+	return settings
+}
+
+// configSource tells where a setting's value comes from, following viper's
+// precedence: flag, env, file, or default
+func configSource(key string, file *viper.Viper) string {
+	if configFlags[key].Changed {
+		return "flag"
+	}
+
+	envs := []string{envReplacer.Replace(strings.ToUpper(envPrefix + "_" + key))}
+	if key == "kube-config" {
+		envs = append(envs, "KUBECONFIG")
+	}
+	for _, env := range envs {
+		if os.Getenv(env) != "" {
+			return "env"
+		}
+	}
+
+	if file != nil && file.IsSet(key) {
+		return "file"
+	}
+
+	return "default"
+}
+
+// printConfigReport displays the effective configuration and its issues, as a table or json
+func printConfigReport(w io.Writer, report *configReport, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	file := report.File
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintf(w, "Configuration file: %s\n\n", file)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, setting := range report.Settings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", setting.Key, formatSetting(setting.Value), setting.Source)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Errors) == 0 {
+		fmt.Fprintln(w, "\nConfiguration is valid")
+		return nil
+	}
+
+	fmt.Fprintln(w, "\nConfiguration issues:")
+	for _, err := range report.Errors {
+		fmt.Fprintf(w, "  - %s\n", err)
+	}
+
+	return nil
+}
+
+// formatSetting displays a setting value on a single line
+func formatSetting(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	if reflect.TypeOf(value).Kind() == reflect.Slice || reflect.TypeOf(value).Kind() == reflect.Map {
+		if raw, err := json.Marshal(value); err == nil {
+			return string(raw)
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
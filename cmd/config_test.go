@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCheckConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "kube-named-ports.yaml")
+
+	tests := []struct {
+		config string
+		errors []string
+	}{
+		{"log:\n  level: info\nresync-interval: 60\nclusters:\n  - name: foo\n    zone: bar\n", nil},
+		{"log:\n  levle: info\nresync-intervall: 60\n", []string{"Unknown keys in " + file + ": log.levle, resync-intervall"}},
+		{"clusters:\n  - name: foo\n    zoen: bar\n", []string{"Invalid clusters list in " + file + ": '[0]' has invalid keys: zoen"}},
+		{"log: [unterminated\n", []string{"Failed to read " + file}},
+	}
+
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(file, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := checkConfigFile(file)
+		if len(errs) != len(tt.errors) {
+			t.Errorf("checkConfigFile(%q) returned %q, expected %q", tt.config, errs, tt.errors)
+			continue
+		}
+		for i := range errs {
+			if !strings.HasPrefix(errs[i], tt.errors[i]) {
+				t.Errorf("checkConfigFile(%q) returned %q, expected %q", tt.config, errs[i], tt.errors[i])
+			}
+		}
+	}
+}
+
+func TestCheckConfigTypes(t *testing.T) {
+	v := viper.New()
+	v.Set("resync-interval", "soon")
+	v.Set("dry-run", "maybe")
+	v.Set("namespaces", []string{"default"})
+	v.Set("healthcheck-port", "8080")
+	v.Set("gcp-rate-limit", "fast")
+
+	errs := checkConfigTypes(v)
+	expected := []string{
+		"Invalid dry-run value maybe (expected bool)",
+		"Invalid gcp-rate-limit value fast (expected float64)",
+		"Invalid resync-interval value soon (expected int)",
+	}
+	if strings.Join(errs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("checkConfigTypes returned %q, expected %q", errs, expected)
+	}
+}
+
+func TestPrintConfigReport(t *testing.T) {
+	report := &configReport{
+		Settings: []configSetting{
+			{Key: "dry-run", Value: true, Source: "flag"},
+			{Key: "namespaces", Value: []string{"default", "web"}, Source: "file"},
+		},
+		Errors: []string{"unknown discovery mode \"foo\" (should be gke or nodes)"},
+	}
+
+	var buf bytes.Buffer
+	if err := printConfigReport(&buf, report, "table"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Configuration file: none\n\n" +
+		"KEY         VALUE              SOURCE\n" +
+		"dry-run     true               flag\n" +
+		"namespaces  [\"default\",\"web\"]  file\n" +
+		"\nConfiguration issues:\n" +
+		"  - unknown discovery mode \"foo\" (should be gke or nodes)\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected config report:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
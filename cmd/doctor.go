@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/doctor"
+)
+
+var (
+	doctorFormat string
+
+	doctorCmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose Kubernetes and GCP permissions and connectivity",
+		Long: "Check the Kubernetes API access and RBAC permissions, the GCP metadata server,\n" +
+			"credentials and IAM permissions kube-named-ports needs, and report the issues found.\n" +
+			"Exits with status 2 when some checks fail.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if doctorFormat != "text" && doctorFormat != "json" {
+				return fmt.Errorf("Unknown output format %q (should be text or json)", doctorFormat)
+			}
+
+			conf, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			reports, err := diagnoseClusters(conf)
+			if err != nil {
+				return err
+			}
+
+			if err = printDiagnoses(cmd.OutOrStdout(), reports, doctorFormat); err != nil {
+				return err
+			}
+
+			for _, report := range reports {
+				if doctor.Failed(report.Checks) {
+					return findingsf("Some checks failed")
+				}
+			}
+
+			return nil
+		},
+	}
+)
+
+// clusterDiagnosis holds a cluster's checks results
+type clusterDiagnosis struct {
+	Cluster string         `json:"cluster"`
+	Checks  []doctor.Check `json:"checks"`
+}
+
+func init() {
+	doctorCmd.Flags().StringVarP(&doctorFormat, "format", "f", "text", "output format: text or json")
+	RootCmd.AddCommand(doctorCmd)
+}
+
+// diagnoseClusters checks each cluster. The Kubernetes clients are built without
+// querying the api-server, so its connectivity is reported as a check, and the
+// clusters that couldn't be initialized are reported as failed.
+func diagnoseClusters(conf *config.KnpConfig) ([]clusterDiagnosis, error) {
+	confs, failures, err := loadClusters(conf, kubeUnchecked)
+	if err != nil && !viper.IsSet("clusters") {
+		failures = []clusterFailure{{Name: conf.Cluster, Err: err}}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var reports []clusterDiagnosis
+	for _, conf := range confs {
+		reports = append(reports, clusterDiagnosis{Cluster: conf.Cluster, Checks: doctor.Run(conf)})
+	}
+
+	for _, failure := range failures {
+		reports = append(reports, clusterDiagnosis{
+			Cluster: failure.Name,
+			Checks: []doctor.Check{{
+				Name:   "Cluster configuration",
+				Status: doctor.StatusFailed,
+				Detail: failure.Err.Error(),
+				Hint:   "fix the cluster's settings",
+			}},
+		})
+	}
+
+	return reports, nil
+}
+
+// printDiagnoses displays the checks results, as text or json
+func printDiagnoses(w io.Writer, reports []clusterDiagnosis, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+
+	for _, report := range reports {
+		fmt.Fprintf(w, "Cluster %s:\n", report.Cluster)
+		for _, check := range report.Checks {
+			line := fmt.Sprintf("  [%-7s] %s", check.Status, check.Name)
+			if check.Detail != "" {
+				line += ": " + check.Detail
+			}
+			fmt.Fprintln(w, line)
+			if check.Hint != "" && check.Status != doctor.StatusOK {
+				fmt.Fprintf(w, "              -> %s\n", check.Hint)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
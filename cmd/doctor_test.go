@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/doctor"
+	klog "github.com/bpineau/kube-named-ports/pkg/log"
+)
+
+func TestDiagnoseClustersFailures(t *testing.T) {
+	FakeCS = true
+	defer func() { FakeCS = false }()
+
+	logger, err := klog.New("", "", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := &config.KnpConfig{Logger: logger, Cluster: "main", Discovery: "gke"}
+
+	viper.Set("clusters", []map[string]interface{}{
+		{"name": "foo", "discovery": "nope"},
+		{"name": "bar", "discovery": "nope"},
+	})
+	defer viper.Set("clusters", nil)
+
+	reports, err := diagnoseClusters(base)
+	if err != nil {
+		t.Fatalf("diagnoseClusters failed: %v", err)
+	}
+	if len(reports) != 2 || reports[0].Cluster != "foo" || reports[1].Cluster != "bar" {
+		t.Fatalf("Each failed cluster should be reported: %+v", reports)
+	}
+	for _, report := range reports {
+		if !doctor.Failed(report.Checks) {
+			t.Errorf("Cluster %s initialization failure should be reported: %+v", report.Cluster, report)
+		}
+	}
+
+	viper.Set("clusters", nil)
+	reports, err = diagnoseClusters(&config.KnpConfig{Logger: logger, Cluster: "main", Discovery: "nope"})
+	if err != nil {
+		t.Fatalf("diagnoseClusters failed: %v", err)
+	}
+	if len(reports) != 1 || reports[0].Cluster != "main" || !doctor.Failed(reports[0].Checks) {
+		t.Errorf("The cluster given by flags should be reported as failed: %+v", reports)
+	}
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -8,15 +10,22 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"k8s.io/client-go/util/homedir"
 
 	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/audit"
 	klog "github.com/bpineau/kube-named-ports/pkg/log"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
 	"github.com/bpineau/kube-named-ports/pkg/run"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
 )
 
-const appName = "kube-named-ports"
+const (
+	appName   = "kube-named-ports"
+	envPrefix = "KMP"
+)
 
 var (
 	version = "0.5.0 (HEAD)"
@@ -28,15 +37,39 @@ var (
 	logLevel  string
 	logOutput string
 	logServer string
+	logFormat string
 	healthP   int
 	resync    int
+	grace     int
+	gcpTmout  int
+	gcpRate   float64
+	gcpBurst  int
+	gcpRetry  int
 	cluster   string
 	zone      string
 	project   string
+	crdCtrl   bool
+	discovery string
+	unmanaged string
+	writeSA   string
+	credsFile string
+	wlIdent   bool
+	imperSA   string
+	delegates []string
+	auditSink string
+	traceEndp string
+	nsInclude []string
+	nsExclude []string
 
 	// FakeCS uses the client-go testing clientset
 	FakeCS bool
 
+	// configFlags maps the configuration keys to their command line flags
+	configFlags = make(map[string]*pflag.Flag)
+
+	// envReplacer maps the configuration keys to environment variables names
+	envReplacer = strings.NewReplacer("-", "_", ".", "_DOT_")
+
 	versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Print the version number",
@@ -51,41 +84,235 @@ var (
 		Short: "Add named ports on GCP node pools",
 		Long:  "Add named ports given by services annotations on GCP node pools",
 
+		// errors are reported by main, which maps findings to a distinct exit status
+		SilenceErrors: true,
+
 		RunE: func(cmd *cobra.Command, args []string) error {
-			conf := &config.KnpConfig{
-				DryRun:     viper.GetBool("dry-run"),
-				Logger:     klog.New(viper.GetString("log.level"), viper.GetString("log.server"), viper.GetString("log.output")),
-				HealthPort: viper.GetInt("healthcheck-port"),
-				ResyncIntv: time.Duration(viper.GetInt("resync-interval")) * time.Second,
-				Cluster:    viper.GetString("cluster"),
-				Zone:       viper.GetString("zone"),
-				Project:    viper.GetString("project"),
-			}
-			if FakeCS {
-				conf.ClientSet = config.FakeClientSet()
+			conf, err := newConfig()
+			if err != nil {
+				return err
 			}
-			err := conf.Init(viper.GetString("api-server"), viper.GetString("kube-config"))
+
+			confs, err := clustersConfigs(conf)
 			if err != nil {
-				return fmt.Errorf("Failed to initialize the configuration: %+v", err)
+				return err
 			}
 
-			if conf.Cluster == "" {
-				return fmt.Errorf("Cluster name must be specified")
+			stopTracing, err := initTracing(conf)
+			if err != nil {
+				return err
 			}
+			defer stopTracing()
 
-			run.Run(conf)
+			watchConfig(confs)
+
+			run.Run(confs...)
 			return nil
 		},
 	}
 )
 
+// newConfig returns the global configuration, built from flags, env and config file
+func newConfig() (*config.KnpConfig, error) {
+	if err := checkConfig(viper.GetViper()); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
+	}
+
+	logger, err := klog.New(viper.GetString("log.level"), viper.GetString("log.server"),
+		viper.GetString("log.output"), viper.GetString("log.format"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize logging: %v", err)
+	}
+
+	return &config.KnpConfig{
+		DryRun:                    viper.GetBool("dry-run"),
+		Logger:                    logger,
+		HealthPort:                viper.GetInt("healthcheck-port"),
+		ResyncIntv:                time.Duration(viper.GetInt("resync-interval")) * time.Second,
+		ShutdownGrace:             time.Duration(viper.GetInt("shutdown-grace-period")) * time.Second,
+		GCPTimeout:                time.Duration(viper.GetInt("gcp-timeout")) * time.Second,
+		GCPRateLimit:              viper.GetFloat64("gcp-rate-limit"),
+		GCPBurst:                  viper.GetInt("gcp-burst"),
+		GCPMaxRetries:             viper.GetInt("gcp-max-retries"),
+		Namespaces:                viper.GetStringSlice("namespaces"),
+		ExcludeNamespaces:         viper.GetStringSlice("exclude-namespaces"),
+		Cluster:                   viper.GetString("cluster"),
+		Zone:                      viper.GetString("zone"),
+		Project:                   viper.GetString("project"),
+		NamedPortCRD:              viper.GetBool("namedport-crd"),
+		Discovery:                 viper.GetString("discovery"),
+		UnmanagedGroups:           viper.GetString("unmanaged-groups"),
+		AuditSink:                 viper.GetString("audit-sink"),
+		TraceEndpoint:             viper.GetString("trace-endpoint"),
+		WriteServiceAccount:       viper.GetString("write-service-account"),
+		CredentialsFile:           viper.GetString("credentials-file"),
+		WorkloadIdentity:          viper.GetBool("workload-identity"),
+		ImpersonateServiceAccount: viper.GetString("impersonate-service-account"),
+		ImpersonateDelegates:      viper.GetStringSlice("impersonate-delegates"),
+	}, nil
+}
+
+// initTracing starts exporting spans, when a traces endpoint is configured.
+// The returned function flushes the pending spans.
+func initTracing(conf *config.KnpConfig) (func(), error) {
+	shutdown, err := tracing.Init(conf.TraceEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize tracing: %v", err)
+	}
+
+	return func() {
+		if err := shutdown(context.Background()); err != nil {
+			conf.Logger.Warningf("Failed to flush traces: %v", err)
+		}
+	}, nil
+}
+
+// kubeInit tells how the clusters' Kubernetes clients are initialized
+type kubeInit int
+
+const (
+	// kubeChecked builds the clients, and verifies the api-server is reachable
+	kubeChecked kubeInit = iota
+	// kubeIfNeeded builds and checks the clients only when the discovery needs them
+	kubeIfNeeded
+	// kubeUnchecked builds the clients without querying the api-server
+	kubeUnchecked
+)
+
+// clusterFailure is a listed cluster that couldn't be initialized
+type clusterFailure struct {
+	Name string
+	Err  error
+}
+
+// clustersConfigs returns a configuration for each managed cluster: the clusters
+// listed in the configuration file if any, or else the cluster given by flags.
+// Listed clusters failing to initialize are skipped, so they can't prevent
+// managing the others.
+func clustersConfigs(conf *config.KnpConfig) ([]*config.KnpConfig, error) {
+	return clustersConfigsFor(conf, kubeChecked)
+}
+
+// clustersConfigsFor returns the usable clusters configurations, with their
+// Kubernetes clients initialized as requested.
+func clustersConfigsFor(conf *config.KnpConfig, kube kubeInit) ([]*config.KnpConfig, error) {
+	confs, failures, err := loadClusters(conf, kube)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, failure := range failures {
+		conf.Logger.Errorf("Ignoring cluster %q: %v", failure.Name, failure.Err)
+	}
+
+	if len(confs) == 0 {
+		return nil, fmt.Errorf("No usable cluster found in configured clusters list")
+	}
+
+	return confs, nil
+}
+
+// loadClusters returns the clusters configurations, and the listed clusters
+// that failed to initialize.
+func loadClusters(conf *config.KnpConfig, kube kubeInit) ([]*config.KnpConfig, []clusterFailure, error) {
+	apiserver, kubeconfig := viper.GetString("api-server"), viper.GetString("kube-config")
+
+	if !viper.IsSet("clusters") {
+		if err := initClusterConfig(conf, apiserver, kubeconfig, kube); err != nil {
+			return nil, nil, err
+		}
+		return []*config.KnpConfig{conf}, nil, nil
+	}
+
+	var clusters []config.ClusterConfig
+	if err := viper.UnmarshalKey("clusters", &clusters); err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse clusters list: %v", err)
+	}
+
+	var confs []*config.KnpConfig
+	var failures []clusterFailure
+	for _, cl := range clusters {
+		cc := conf.ForCluster(cl)
+
+		capiserver, ckubeconfig := apiserver, kubeconfig
+		if cl.APIServer != "" {
+			capiserver = cl.APIServer
+		}
+		if cl.KubeConfig != "" {
+			ckubeconfig = cl.KubeConfig
+		}
+
+		if err := initClusterConfig(cc, capiserver, ckubeconfig, kube); err != nil {
+			failures = append(failures, clusterFailure{Name: cl.Name, Err: err})
+			continue
+		}
+
+		confs = append(confs, cc)
+	}
+
+	return confs, failures, nil
+}
+
+// initClusterConfig check a cluster's settings, and initialize its clients
+func initClusterConfig(conf *config.KnpConfig, apiserver string, kubeconfig string, kube kubeInit) error {
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+
+	if FakeCS {
+		conf.ClientSet = config.FakeClientSet()
+		conf.DynClient = config.FakeDynClient()
+	}
+
+	switch {
+	case kube == kubeUnchecked:
+		if err := conf.NewClients(apiserver, kubeconfig); err != nil {
+			return fmt.Errorf("Failed to initialize the configuration: %+v", err)
+		}
+	case kube == kubeChecked || conf.Discovery == np.DiscoveryNodes:
+		if err := conf.Init(apiserver, kubeconfig); err != nil {
+			return fmt.Errorf("Failed to initialize the configuration: %+v", err)
+		}
+	}
+
+	auditor, err := audit.NewSink(conf.AuditSink, conf.ClientSet, conf.DynClient)
+	if err != nil {
+		return fmt.Errorf("Invalid audit sink: %v", err)
+	}
+	conf.Auditor = auditor
+
+	return nil
+}
+
+// ErrFindings is matched, with errors.Is, by the errors reporting issues found
+// by a check command (a drift, invalid declarations, failed checks), as opposed
+// to failures to run the command.
+var ErrFindings = errors.New("findings reported")
+
+// findings is an error reporting issues found by a check command
+type findings string
+
+func (f findings) Error() string {
+	return string(f)
+}
+
+func (f findings) Is(target error) bool {
+	return target == ErrFindings
+}
+
+// findingsf returns an error reporting findings, matching ErrFindings
+func findingsf(format string, args ...interface{}) error {
+	return findings(fmt.Sprintf(format, args...))
+}
+
 // Execute adds all child commands to the root command and sets their flags.
 func Execute() error {
 	return RootCmd.Execute()
 }
 
 func bindPFlag(key string, cmd string) {
-	if err := viper.BindPFlag(key, RootCmd.PersistentFlags().Lookup(cmd)); err != nil {
+	configFlags[key] = RootCmd.PersistentFlags().Lookup(cmd)
+	if err := viper.BindPFlag(key, configFlags[key]); err != nil {
 		log.Fatal("Failed to bind cli argument:", err)
 	}
 }
@@ -112,19 +339,37 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "v", "debug", "log level")
 	bindPFlag("log.level", "log-level")
 
-	RootCmd.PersistentFlags().StringVarP(&logOutput, "log-output", "o", "stderr", "log output")
+	RootCmd.PersistentFlags().StringVarP(&logOutput, "log-output", "o", "stderr", "log output: stderr, stdout, syslog, or file:<path> (with optional rotation settings)")
 	bindPFlag("log.output", "log-output")
 
-	RootCmd.PersistentFlags().StringVarP(&logServer, "log-server", "r", "", "log server (if using syslog)")
+	RootCmd.PersistentFlags().StringVarP(&logServer, "log-server", "r", "", "syslog server, as host:port (udp) or udp://, tcp:// or tls:// url (if using syslog)")
 	bindPFlag("log.server", "log-server")
 
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format: text, json or gcp (json for Cloud Logging)")
+	bindPFlag("log.format", "log-format")
+
 	RootCmd.PersistentFlags().IntVarP(&healthP, "healthcheck-port", "p", 0, "port for answering healthchecks")
 	bindPFlag("healthcheck-port", "healthcheck-port")
 
 	RootCmd.PersistentFlags().IntVarP(&resync, "resync-interval", "i", 900, "resync interval in seconds (0 to disable)")
 	bindPFlag("resync-interval", "resync-interval")
 
-	RootCmd.PersistentFlags().StringVarP(&cluster, "cluster", "n", "", "cluster name (mandatory)")
+	RootCmd.PersistentFlags().IntVar(&grace, "shutdown-grace-period", 20, "seconds to wait, on shutdown, for an ongoing resync to complete")
+	bindPFlag("shutdown-grace-period", "shutdown-grace-period")
+
+	RootCmd.PersistentFlags().IntVar(&gcpTmout, "gcp-timeout", 60, "timeout in seconds of each GCP API call (0 to disable)")
+	bindPFlag("gcp-timeout", "gcp-timeout")
+
+	RootCmd.PersistentFlags().Float64Var(&gcpRate, "gcp-rate-limit", 10, "maximum GCP API calls per second and project (0 to disable)")
+	bindPFlag("gcp-rate-limit", "gcp-rate-limit")
+
+	RootCmd.PersistentFlags().IntVar(&gcpBurst, "gcp-burst", 10, "GCP API calls allowed in a burst above the rate limit")
+	bindPFlag("gcp-burst", "gcp-burst")
+
+	RootCmd.PersistentFlags().IntVar(&gcpRetry, "gcp-max-retries", 5, "retries of rate limited or failing (5xx) GCP API calls")
+	bindPFlag("gcp-max-retries", "gcp-max-retries")
+
+	RootCmd.PersistentFlags().StringVarP(&cluster, "cluster", "n", "", "cluster name (mandatory with gke discovery)")
 	bindPFlag("cluster", "cluster")
 
 	RootCmd.PersistentFlags().StringVarP(&zone, "zone", "z", "", "cluster zone name (optional, can be guessed)")
@@ -132,6 +377,42 @@ func init() {
 
 	RootCmd.PersistentFlags().StringVarP(&project, "project", "j", "", "project (optional when in cluster, can be found in host's metadata")
 	bindPFlag("project", "project")
+
+	RootCmd.PersistentFlags().BoolVarP(&crdCtrl, "namedport-crd", "m", false, "also watch NamedPort custom resources")
+	bindPFlag("namedport-crd", "namedport-crd")
+
+	RootCmd.PersistentFlags().StringVarP(&discovery, "discovery", "", np.DiscoveryGKE, "instance groups discovery mode: gke (node pools API) or nodes (from Kubernetes nodes)")
+	bindPFlag("discovery", "discovery")
+
+	RootCmd.PersistentFlags().StringVarP(&unmanaged, "unmanaged-groups", "", "", "regexp matching unmanaged instance groups names to handle too")
+	bindPFlag("unmanaged-groups", "unmanaged-groups")
+
+	RootCmd.PersistentFlags().StringVarP(&writeSA, "write-service-account", "", "", "service account impersonated to update named ports (optional)")
+	bindPFlag("write-service-account", "write-service-account")
+
+	RootCmd.PersistentFlags().StringVarP(&credsFile, "credentials-file", "", "", "GCP credentials file (optional, defaults to application default credentials)")
+	bindPFlag("credentials-file", "credentials-file")
+
+	RootCmd.PersistentFlags().BoolVarP(&wlIdent, "workload-identity", "", false, "use the metadata server (Workload Identity) GCP credentials")
+	bindPFlag("workload-identity", "workload-identity")
+
+	RootCmd.PersistentFlags().StringVarP(&imperSA, "impersonate-service-account", "", "", "service account impersonated for all GCP calls (optional)")
+	bindPFlag("impersonate-service-account", "impersonate-service-account")
+
+	RootCmd.PersistentFlags().StringSliceVarP(&delegates, "impersonate-delegates", "", nil, "delegates chain used to impersonate the service account (optional)")
+	bindPFlag("impersonate-delegates", "impersonate-delegates")
+
+	RootCmd.PersistentFlags().StringVar(&auditSink, "audit-sink", "", "named ports changes audit sink: stdout (written to stderr), file:<path> or events (optional)")
+	bindPFlag("audit-sink", "audit-sink")
+
+	RootCmd.PersistentFlags().StringSliceVar(&nsInclude, "namespaces", nil, "only consider services from those namespaces (optional, defaults to all)")
+	bindPFlag("namespaces", "namespaces")
+
+	RootCmd.PersistentFlags().StringSliceVar(&nsExclude, "exclude-namespaces", nil, "ignore services from those namespaces (optional)")
+	bindPFlag("exclude-namespaces", "exclude-namespaces")
+
+	RootCmd.PersistentFlags().StringVar(&traceEndp, "trace-endpoint", "", "export traces with the stdout exporter (written to stderr), or to an OTLP/HTTP collector url (optional)")
+	bindPFlag("trace-endpoint", "trace-endpoint")
 }
 
 func initConfig() {
@@ -151,9 +432,8 @@ func initConfig() {
 	}
 
 	// allow config params through prefixed env variables
-	viper.SetEnvPrefix("KMP")
-	replacer := strings.NewReplacer("-", "_", ".", "_DOT_")
-	viper.SetEnvKeyReplacer(replacer)
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(envReplacer)
 	viper.AutomaticEnv()
 
 	if err := viper.ReadInConfig(); err == nil {
@@ -5,6 +5,11 @@ import (
 	//"syscall"
 	"testing"
 	//"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/bpineau/kube-named-ports/config"
+	klog "github.com/bpineau/kube-named-ports/pkg/log"
 )
 
 // most of cli binding code is executed through the magical init() mecanism
@@ -83,3 +88,45 @@ func TestVersion(t *testing.T) {
 		t.Errorf("version subcommand shouldn't fail: %+v", err)
 	}
 }
+
+func TestClustersConfigs(t *testing.T) {
+	FakeCS = true
+	defer func() { FakeCS = false }()
+
+	logger, err := klog.New("", "", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := &config.KnpConfig{
+		Logger:    logger,
+		Discovery: "gke",
+		Project:   "global-project",
+	}
+
+	viper.Set("clusters", []map[string]interface{}{
+		{"name": "foo", "zone": "europe-west1-b", "kube-context": "foo-ctx"},
+		{"name": "bar", "project": "bar-project", "discovery": "nodes"},
+		{"name": "", "discovery": "gke"},
+	})
+	defer viper.Set("clusters", nil)
+
+	confs, err := clustersConfigs(base)
+	if err != nil {
+		t.Fatalf("clustersConfigs failed: %v", err)
+	}
+	if len(confs) != 2 {
+		t.Fatalf("clustersConfigs should skip invalid clusters, got %d clusters", len(confs))
+	}
+	if confs[0].Cluster != "foo" || confs[0].KubeContext != "foo-ctx" || confs[0].Project != "global-project" {
+		t.Errorf("Unexpected first cluster configuration: %+v", confs[0])
+	}
+	if confs[1].Project != "bar-project" || confs[1].Discovery != "nodes" {
+		t.Errorf("Unexpected second cluster configuration: %+v", confs[1])
+	}
+
+	viper.Set("clusters", []map[string]interface{}{{"name": ""}})
+	if _, err = clustersConfigs(base); err == nil {
+		t.Error("clustersConfigs should fail without any usable cluster")
+	}
+}
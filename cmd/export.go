@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var (
+	exportFormat string
+
+	exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the desired named ports",
+		Long: "Dump the desired named ports, with their owners and targets, as declared by services\n" +
+			"annotations (and NamedPort resources when enabled). The output can be applied later\n" +
+			"with the import subcommand.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if exportFormat != "yaml" && exportFormat != "json" {
+				return fmt.Errorf("Unknown output format %q (should be yaml or json)", exportFormat)
+			}
+
+			conf, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			confs, failures, err := loadClusters(conf, kubeChecked)
+			if err != nil {
+				return err
+			}
+
+			var exports []clusterPorts
+			for _, conf := range confs {
+				claims, err := listClaims(conf)
+				if err != nil {
+					return err
+				}
+
+				exports = append(exports, clusterPorts{Cluster: conf.Cluster, Ports: sortClaims(claims)})
+			}
+
+			for _, failure := range failures {
+				exports = append(exports, clusterPorts{Cluster: failure.Name, Error: failure.Err.Error()})
+			}
+
+			if err = printExports(cmd.OutOrStdout(), exports, exportFormat); err != nil {
+				return err
+			}
+
+			if len(confs) == 0 {
+				return fmt.Errorf("No usable cluster found in configured clusters list")
+			}
+
+			return nil
+		},
+	}
+)
+
+// clusterPorts holds a cluster's desired named ports, as exported and imported,
+// or the reason why the cluster was skipped by the export
+type clusterPorts struct {
+	Cluster string     `json:"cluster"`
+	Ports   []np.Claim `json:"ports"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "yaml", "output format: yaml or json")
+	RootCmd.AddCommand(exportCmd)
+}
+
+// sortClaims orders claims by port name then owner, for stable exports
+func sortClaims(claims []np.Claim) []np.Claim {
+	sort.Slice(claims, func(i, j int) bool {
+		if claims[i].Name != claims[j].Name {
+			return claims[i].Name < claims[j].Name
+		}
+		return claims[i].Owner < claims[j].Owner
+	})
+	return claims
+}
+
+// printExports displays the desired named ports, as yaml or json
+func printExports(w io.Writer, exports []clusterPorts, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exports)
+	}
+
+	out, err := yaml.Marshal(exports)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	return err
+}
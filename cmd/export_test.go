@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+func TestExportImport(t *testing.T) {
+	exports := []clusterPorts{{
+		Cluster: "foo",
+		Ports: sortClaims([]np.Claim{
+			{Owner: "service/default/web", Name: "http", Port: 8080},
+			{Owner: "namedport/gpu", Name: "gpu", Port: 9090, Target: np.PortTarget{NodePools: []string{"gpu-pool"}}},
+		}),
+	}}
+
+	for _, format := range []string{"yaml", "json"} {
+		var buf bytes.Buffer
+		if err := printExports(&buf, exports, format); err != nil {
+			t.Fatal(err)
+		}
+
+		imports, err := readImport("-", &buf)
+		if err != nil {
+			t.Fatalf("Failed to import %s export: %v", format, err)
+		}
+
+		if len(imports) != 1 || len(imports[0].Ports) != 2 || imports[0].Ports[0].Name != "gpu" ||
+			imports[0].Ports[0].Target.NodePools[0] != "gpu-pool" {
+			t.Errorf("Unexpected %s import: %+v", format, imports)
+		}
+	}
+}
+
+func TestReadImportErrors(t *testing.T) {
+	for _, tc := range []struct{ doc, err string }{
+		{"- cluster: foo\n  prots: []\n", "Failed to parse"},
+		{"- cluster: foo\n- cluster: foo\n", "listed several times"},
+		{"- cluster: foo\n  error: unreachable\n", "skipped by the export"},
+		{"- cluster: foo\n  ports: [{name: http, port: 0}]\n", "invalid port value"},
+		{"- cluster: foo\n  ports: [{name: http, port: 80, target: {selector: '!!'}}]\n", "Invalid target"},
+		{"- cluster: foo\n  ports: [{name: http, port: 80}, {name: http, port: 81}]\n", "conflicting values"},
+	} {
+		_, err := readImport("-", strings.NewReader(tc.doc))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected %q error importing %q, got %v", tc.err, tc.doc, err)
+		}
+	}
+}
+
+func TestApplyImportsUnknownCluster(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.Cluster = "foo"
+
+	_, err := applyImports([]*config.KnpConfig{conf}, []clusterPorts{{Cluster: "foo"}, {Cluster: "bar"}})
+	if err == nil || !strings.Contains(err.Error(), `"bar"`) {
+		t.Errorf("Expected an unknown cluster error, got %v", err)
+	}
+}
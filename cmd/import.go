@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var (
+	importFile   string
+	importFormat string
+
+	importCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Apply exported named ports to instance groups",
+		Long: "Apply a file produced by the export subcommand (\"-\" for stdin) as the desired named ports,\n" +
+			"directly to the instance groups, without reading services annotations. Only clusters\n" +
+			"listed in the file are updated. Kubernetes access isn't needed with gke discovery.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if importFormat != "text" && importFormat != "json" {
+				return fmt.Errorf("Unknown output format %q (should be text or json)", importFormat)
+			}
+
+			if importFile == "" {
+				return fmt.Errorf("No file to import provided (use -f)")
+			}
+
+			imports, err := readImport(importFile, cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+
+			conf, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			confs, err := clustersConfigsFor(conf, kubeIfNeeded)
+			if err != nil {
+				return err
+			}
+
+			results, err := applyImports(confs, imports)
+			if err != nil {
+				return err
+			}
+
+			if err = printSyncResults(cmd.OutOrStdout(), results, importFormat); err != nil {
+				return err
+			}
+
+			for _, result := range results {
+				if result.Error != "" {
+					return fmt.Errorf("Named ports import failed on cluster %s", result.Cluster)
+				}
+			}
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	importCmd.Flags().StringVarP(&importFile, "filename", "f", "", "file to import (\"-\" for stdin)")
+	importCmd.Flags().StringVar(&importFormat, "format", "text", "output format: text or json")
+	RootCmd.AddCommand(importCmd)
+}
+
+// readImport parses and checks an exported named ports file
+func readImport(file string, stdin io.Reader) ([]clusterPorts, error) {
+	var (
+		data    []byte
+		err     error
+		imports []clusterPorts
+	)
+
+	if file == "-" {
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+	}
+
+	if err = yaml.UnmarshalStrict(data, &imports); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", file, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, imp := range imports {
+		if seen[imp.Cluster] {
+			return nil, fmt.Errorf("Cluster %q is listed several times in %s", imp.Cluster, file)
+		}
+		seen[imp.Cluster] = true
+
+		if imp.Error != "" {
+			return nil, fmt.Errorf("Cluster %q was skipped by the export (%s): remove it from %s to import the others",
+				imp.Cluster, imp.Error, file)
+		}
+
+		for _, claim := range imp.Ports {
+			if err = np.ValidatePort(claim.Name, claim.Port); err != nil {
+				return nil, fmt.Errorf("Invalid port for cluster %q: %v", imp.Cluster, err)
+			}
+
+			_, err = np.ParsePortTarget(strings.Join(claim.Target.NodePools, ","), claim.Target.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid target for port %q on cluster %q: %v", claim.Name, imp.Cluster, err)
+			}
+		}
+
+		for name := range np.Conflicts(imp.Ports) {
+			return nil, fmt.Errorf("Port %q has conflicting values for cluster %q", name, imp.Cluster)
+		}
+	}
+
+	return imports, nil
+}
+
+// applyImports applies the imported named ports to the matching configured clusters
+func applyImports(confs []*config.KnpConfig, imports []clusterPorts) ([]clusterSync, error) {
+	byCluster := make(map[string]*config.KnpConfig)
+	for _, conf := range confs {
+		byCluster[conf.Cluster] = conf
+	}
+
+	// don't apply anything unless all clusters are known
+	for _, imp := range imports {
+		if _, ok := byCluster[imp.Cluster]; !ok {
+			return nil, fmt.Errorf("Cluster %q isn't configured", imp.Cluster)
+		}
+	}
+
+	var results []clusterSync
+	for _, imp := range imports {
+		results = append(results, applyClaims(byCluster[imp.Cluster], imp.Ports))
+	}
+
+	return results, nil
+}
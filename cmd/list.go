@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var (
+	listFormat string
+
+	listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the instance groups current named ports",
+		Long: "List the node pools instance groups and their current named ports, with the services\n" +
+			"(or NamedPort resources) claiming them. Unclaimed named ports are reported as foreign.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if listFormat != "table" && listFormat != "json" && listFormat != "yaml" {
+				return fmt.Errorf("Unknown output format %q (should be table, json or yaml)", listFormat)
+			}
+
+			conf, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			confs, failures, err := loadClusters(conf, kubeChecked)
+			if err != nil {
+				return err
+			}
+
+			var inventories []clusterInventory
+			for _, conf := range confs {
+				claims, err := listClaims(conf)
+				if err != nil {
+					return err
+				}
+
+				namer, err := np.NewNamedPort(context.Background(), conf)
+				if err != nil {
+					return err
+				}
+
+				igs, err := namer.Inventory(context.Background(), claims)
+				if err != nil {
+					return fmt.Errorf("Failed to list instance groups for cluster %s: %v", conf.Cluster, err)
+				}
+
+				inventories = append(inventories, clusterInventory{Cluster: conf.Cluster, InstanceGroups: igs})
+			}
+
+			for _, failure := range failures {
+				inventories = append(inventories, clusterInventory{Cluster: failure.Name, Error: failure.Err.Error()})
+			}
+
+			if err = printInventories(cmd.OutOrStdout(), inventories, listFormat); err != nil {
+				return err
+			}
+
+			if len(confs) == 0 {
+				return fmt.Errorf("No usable cluster found in configured clusters list")
+			}
+
+			return nil
+		},
+	}
+)
+
+// clusterInventory holds a cluster's instance groups and named ports, or the
+// reason why the cluster was skipped
+type clusterInventory struct {
+	Cluster        string                 `json:"cluster"`
+	InstanceGroups []np.InstanceGroupInfo `json:"instanceGroups"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+func init() {
+	listCmd.Flags().StringVarP(&listFormat, "format", "f", "table", "output format: table, json or yaml")
+	RootCmd.AddCommand(listCmd)
+}
+
+// printInventories displays the instance groups named ports, as a table, json or yaml
+func printInventories(w io.Writer, inventories []clusterInventory, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(inventories)
+	case "yaml":
+		out, err := yaml.Marshal(inventories)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tNODE POOL\tINSTANCE GROUP\tZONE\tPORT NAME\tPORT\tCLAIMED BY")
+	for _, inv := range inventories {
+		for _, ig := range inv.InstanceGroups {
+			pool := ig.NodePool
+			if pool == "" {
+				pool = "-"
+			}
+
+			if len(ig.Ports) == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t-\t-\t-\n", inv.Cluster, pool, ig.Name, ig.Zone)
+			}
+
+			for _, port := range ig.Ports {
+				owners := "<foreign>"
+				if !port.Foreign {
+					owners = strings.Join(port.Owners, ",")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+					inv.Cluster, pool, ig.Name, ig.Zone, port.Name, port.Port, owners)
+			}
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, inv := range inventories {
+		if inv.Error != "" {
+			fmt.Fprintf(w, "Skipped cluster %s: %s\n", inv.Cluster, inv.Error)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var testInventories = []clusterInventory{{
+	Cluster: "foo",
+	InstanceGroups: []np.InstanceGroupInfo{
+		{
+			Zone:     "europe-west1-b",
+			Name:     "gke-foo-default-pool-1234abcd-grp",
+			NodePool: "default-pool",
+			Ports: []np.PortInfo{
+				{Name: "http", Port: 8080, Owners: []string{"service/default/web"}},
+				{Name: "legacy", Port: 1234, Foreign: true},
+			},
+		},
+		{Zone: "europe-west1-c", Name: "legacy-nodes"},
+	},
+}, {
+	Cluster: "bar",
+	Error:   "Invalid configuration: unknown discovery",
+}}
+
+func TestPrintInventories(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printInventories(&buf, testInventories, "table"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Unexpected table:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[1], "service/default/web") || !strings.Contains(lines[2], "<foreign>") {
+		t.Errorf("Table lacks ports owners:\n%s", buf.String())
+	}
+	if !strings.HasPrefix(lines[3], "foo") || !strings.Contains(lines[3], "legacy-nodes") {
+		t.Errorf("Table lacks instance groups without ports:\n%s", buf.String())
+	}
+	if lines[4] != "Skipped cluster bar: Invalid configuration: unknown discovery" {
+		t.Errorf("Table lacks skipped clusters:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := printInventories(&buf, testInventories, "yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []clusterInventory
+	if err := yaml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid yaml inventory: %v", err)
+	}
+	if len(decoded) != 2 || len(decoded[0].InstanceGroups) != 2 || decoded[1].Error == "" {
+		t.Errorf("Unexpected yaml inventory: %+v", decoded)
+	}
+}
+
+func TestListCmdFormat(t *testing.T) {
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs([]string{"list", "--format", "xml"})
+	if err := Execute(); err == nil {
+		t.Error("list should fail with an unknown output format")
+	}
+	listFormat = "table"
+}
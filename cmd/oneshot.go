@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/crd"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/services"
+)
+
+// listClaims lists, in one go, the named ports declared on a cluster by
+// services annotations, and by NamedPort resources when enabled.
+func listClaims(conf *config.KnpConfig) ([]np.Claim, error) {
+	claims, err := services.ListClaims(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.NamedPortCRD {
+		crdClaims, err := crd.ListClaims(conf)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, crdClaims...)
+	}
+
+	return claims, nil
+}
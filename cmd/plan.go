@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var (
+	planFormat string
+
+	planCmd = &cobra.Command{
+		Use:   "plan",
+		Short: "Show the named ports changes a sync would apply",
+		Long: "Show the named ports changes a sync would apply on each instance group, without applying them.\n" +
+			"Exits with status 2 when changes are needed, and 1 when some clusters couldn't be planned.\n" +
+			"Existing named ports are never removed.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if planFormat != "text" && planFormat != "json" {
+				return fmt.Errorf("Unknown output format %q (should be text or json)", planFormat)
+			}
+
+			conf, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			plans, failed, err := planClusters(conf)
+			if err != nil {
+				return err
+			}
+
+			if err = printPlans(cmd.OutOrStdout(), plans, planFormat); err != nil {
+				return err
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("Failed to plan changes for %d clusters", failed)
+			}
+
+			if n := countChanges(plans); n > 0 {
+				return findingsf("Named ports drift detected on %d instance groups", n)
+			}
+
+			return nil
+		},
+	}
+)
+
+// clusterPlan holds the changes needed on a cluster's instance groups
+type clusterPlan struct {
+	Cluster        string                 `json:"cluster"`
+	InstanceGroups []np.InstanceGroupPlan `json:"instanceGroups"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+func init() {
+	planCmd.Flags().StringVarP(&planFormat, "format", "f", "text", "output format: text or json")
+	RootCmd.AddCommand(planCmd)
+}
+
+// planClusters plans the changes on each cluster, and counts the clusters
+// (including the listed ones failing to initialize) that couldn't be planned.
+func planClusters(conf *config.KnpConfig) ([]clusterPlan, int, error) {
+	confs, failures, err := loadClusters(conf, kubeChecked)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var plans []clusterPlan
+	failed := 0
+	for _, conf := range confs {
+		plan := planCluster(conf)
+		if plan.Error != "" {
+			failed++
+		}
+		plans = append(plans, plan)
+	}
+
+	for _, failure := range failures {
+		failed++
+		plans = append(plans, clusterPlan{Cluster: failure.Name, Error: failure.Err.Error()})
+	}
+
+	return plans, failed, nil
+}
+
+// planCluster plans the changes needed on a cluster's instance groups
+func planCluster(conf *config.KnpConfig) clusterPlan {
+	plan := clusterPlan{Cluster: conf.Cluster}
+
+	claims, err := listClaims(conf)
+	if err != nil {
+		plan.Error = err.Error()
+		return plan
+	}
+
+	namer, err := np.NewNamedPort(context.Background(), conf)
+	if err != nil {
+		plan.Error = err.Error()
+		return plan
+	}
+
+	expected, targets := np.FromClaims(claims)
+	plan.InstanceGroups, err = namer.Plan(context.Background(), expected, targets)
+	if err != nil {
+		plan.Error = fmt.Sprintf("Failed to plan changes: %v", err)
+	}
+
+	return plan
+}
+
+func countChanges(plans []clusterPlan) int {
+	count := 0
+	for _, plan := range plans {
+		count += len(plan.InstanceGroups)
+	}
+	return count
+}
+
+// printPlans displays the plans, in a terraform like fashion or as json
+func printPlans(w io.Writer, plans []clusterPlan, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	}
+
+	for _, plan := range plans {
+		fmt.Fprintf(w, "Cluster %s:\n", plan.Cluster)
+		if plan.Error != "" {
+			fmt.Fprintf(w, "  Error: %s\n", plan.Error)
+		} else if len(plan.InstanceGroups) == 0 {
+			fmt.Fprintf(w, "  No changes.\n")
+		}
+
+		for _, ig := range plan.InstanceGroups {
+			fmt.Fprintf(w, "  ~ instance group %s (project %s, zone %s", ig.Name, ig.Project, ig.Zone)
+			if ig.NodePool != "" {
+				fmt.Fprintf(w, ", node pool %s", ig.NodePool)
+			}
+			fmt.Fprintf(w, ")\n")
+
+			for _, change := range ig.Changes {
+				switch change.Action {
+				case np.ActionAdd:
+					fmt.Fprintf(w, "      + %s: %d\n", change.Name, change.After)
+				case np.ActionChange:
+					fmt.Fprintf(w, "      ~ %s: %d -> %d\n", change.Name, change.Before, change.After)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\nPlan: %d instance groups to update.\n", countChanges(plans))
+	return nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/bpineau/kube-named-ports/config"
+	klog "github.com/bpineau/kube-named-ports/pkg/log"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var testPlans = []clusterPlan{
+	{Cluster: "foo"},
+	{Cluster: "baz", Error: "Invalid configuration: unknown discovery"},
+	{
+		Cluster: "bar",
+		InstanceGroups: []np.InstanceGroupPlan{{
+			Project:  "my-project",
+			Zone:     "europe-west1-b",
+			Name:     "gke-bar-default-pool-1234abcd-grp",
+			NodePool: "default-pool",
+			Changes: []np.PortChange{
+				{Action: np.ActionAdd, Name: "http", After: 8080},
+				{Action: np.ActionChange, Name: "metrics", Before: 9090, After: 9091},
+			},
+		}},
+	},
+}
+
+func TestPrintPlans(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printPlans(&buf, testPlans, "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		"Cluster foo:\n  No changes.",
+		"Cluster baz:\n  Error: Invalid configuration: unknown discovery",
+		"~ instance group gke-bar-default-pool-1234abcd-grp (project my-project, zone europe-west1-b, node pool default-pool)",
+		"+ http: 8080",
+		"~ metrics: 9090 -> 9091",
+		"Plan: 1 instance groups to update.",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Text plan lacks %q:\n%s", expected, out)
+		}
+	}
+
+	buf.Reset()
+	if err := printPlans(&buf, testPlans, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []clusterPlan
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid json plan: %v", err)
+	}
+	if len(decoded) != 3 || countChanges(decoded) != 1 || decoded[1].Error == "" {
+		t.Errorf("Unexpected json plan: %+v", decoded)
+	}
+}
+
+func TestPlanClustersFailures(t *testing.T) {
+	FakeCS = true
+	defer func() { FakeCS = false }()
+
+	logger, err := klog.New("", "", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("clusters", []map[string]interface{}{
+		{"name": "foo", "discovery": "nope"},
+		{"name": "bar", "discovery": "nope"},
+	})
+	defer viper.Set("clusters", nil)
+
+	plans, failed, err := planClusters(&config.KnpConfig{Logger: logger, Discovery: "gke"})
+	if err != nil {
+		t.Fatalf("planClusters failed: %v", err)
+	}
+	if failed != 2 || len(plans) != 2 || plans[0].Cluster != "foo" || plans[1].Error == "" {
+		t.Errorf("Each failed cluster should be reported: %d failed, %+v", failed, plans)
+	}
+}
+
+func TestPlanCmdFormat(t *testing.T) {
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs([]string{"plan", "--format", "yaml"})
+	if err := Execute(); err == nil {
+		t.Error("plan should fail with an unknown output format")
+	}
+	planFormat = "text"
+}
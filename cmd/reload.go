@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/bpineau/kube-named-ports/config"
+)
+
+// watchConfig applies the configuration file changes to the clusters settings
+// that can be changed at runtime: log level, dry-run, resync interval and
+// namespaces filters. Invalid configurations are rejected, and the previous
+// settings are kept.
+func watchConfig(confs []*config.KnpConfig) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		reloadConfig(confs)
+	})
+	viper.WatchConfig()
+}
+
+// reloadConfig applies the current dynamic settings to all clusters
+func reloadConfig(confs []*config.KnpConfig) {
+	logger := confs[0].Logger
+
+	dyn, err := dynamicConfig(viper.GetViper())
+	if err != nil {
+		logger.Errorf("Rejecting configuration reload: %v", err)
+		return
+	}
+
+	for _, conf := range confs {
+		conf.Reload(dyn)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"log_level":       dyn.LogLevel.String(),
+		"dry_run":         dyn.DryRun,
+		"resync_interval": dyn.ResyncIntv.String(),
+	}).Infof("Configuration reloaded")
+}
+
+// dynamicConfig returns the settings that can be changed at runtime, once validated
+func dynamicConfig(v *viper.Viper) (config.Dynamic, error) {
+	var dyn config.Dynamic
+
+	// viper silently keeps the previous settings when the file can't be parsed
+	if err := checkConfig(v); err != nil {
+		return dyn, err
+	}
+
+	level, err := logrus.ParseLevel(v.GetString("log.level"))
+	if err != nil {
+		return dyn, fmt.Errorf("Invalid log level: %v", err)
+	}
+
+	dyn.LogLevel = level
+	dyn.DryRun = v.GetBool("dry-run")
+	dyn.ResyncIntv = time.Duration(v.GetInt("resync-interval")) * time.Second
+	dyn.Namespaces = v.GetStringSlice("namespaces")
+	dyn.ExcludeNamespaces = v.GetStringSlice("exclude-namespaces")
+
+	if err = dyn.Validate(); err != nil {
+		return dyn, fmt.Errorf("Invalid configuration: %v", err)
+	}
+
+	return dyn, nil
+}
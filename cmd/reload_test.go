@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func TestDynamicConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knp-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "kube-named-ports.yaml")
+
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{"log:\n  level: warning\ndry-run: true\nresync-interval: 60\nnamespaces: [default]\n", true},
+		{"log:\n  level: loud\n", false},
+		{"dry-run: maybe\n", false},
+		{"resync-interval: -1\n", false},
+		{"resync-interval: soon\n", false},
+		{"log: [unterminated\n", false},
+		{"log:\n  levle: info\n", false},
+		{"namespaces: [Default]\n", false},
+	}
+
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(file, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		v := viper.New()
+		v.SetConfigFile(file)
+		_ = v.ReadInConfig()
+
+		dyn, err := dynamicConfig(v)
+		if tt.valid != (err == nil) {
+			t.Errorf("dynamicConfig(%q) returned %v, expected valid=%v", tt.config, err, tt.valid)
+			continue
+		}
+
+		if tt.valid && (dyn.LogLevel != logrus.WarnLevel || !dyn.DryRun ||
+			dyn.ResyncIntv != time.Minute || len(dyn.Namespaces) != 1) {
+			t.Errorf("Unexpected dynamic configuration: %+v", dyn)
+		}
+	}
+}
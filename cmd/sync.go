@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+var (
+	syncFormat string
+
+	syncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Sync named ports once, then exit",
+		Long: "List services annotations (and NamedPort resources when enabled) once, perform a single\n" +
+			"named ports resync, report the instance groups having each named port, and exit.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if syncFormat != "text" && syncFormat != "json" {
+				return fmt.Errorf("Unknown output format %q (should be text or json)", syncFormat)
+			}
+
+			conf, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			confs, failures, err := loadClusters(conf, kubeChecked)
+			if err != nil {
+				return err
+			}
+
+			stopTracing, err := initTracing(conf)
+			if err != nil {
+				return err
+			}
+			defer stopTracing()
+
+			var results []clusterSync
+			failed := 0
+			for _, conf := range confs {
+				result := syncCluster(conf)
+				if result.Error != "" {
+					failed++
+				}
+				results = append(results, result)
+			}
+
+			for _, failure := range failures {
+				failed++
+				results = append(results, clusterSync{Cluster: failure.Name, Error: failure.Err.Error()})
+			}
+
+			if err = printSyncResults(cmd.OutOrStdout(), results, syncFormat); err != nil {
+				return err
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("Named ports sync failed on %d clusters", failed)
+			}
+
+			return nil
+		},
+	}
+)
+
+// clusterSync is a cluster's resync outcome
+type clusterSync struct {
+	Cluster string        `json:"cluster"`
+	Ports   np.PortList   `json:"ports"`
+	Status  np.SyncStatus `json:"status"`
+	Error   string        `json:"error,omitempty"`
+}
+
+func init() {
+	syncCmd.Flags().StringVarP(&syncFormat, "format", "f", "text", "output format: text or json")
+	RootCmd.AddCommand(syncCmd)
+}
+
+// syncCluster performs a single resync of a cluster's named ports
+func syncCluster(conf *config.KnpConfig) clusterSync {
+	claims, err := listClaims(conf)
+	if err != nil {
+		return clusterSync{Cluster: conf.Cluster, Status: np.SyncStatus{}, Error: err.Error()}
+	}
+
+	return applyClaims(conf, claims)
+}
+
+// applyClaims performs a single resync of a cluster's named ports to the claimed ones
+func applyClaims(conf *config.KnpConfig, claims []np.Claim) clusterSync {
+	result := clusterSync{Cluster: conf.Cluster, Status: np.SyncStatus{}}
+
+	expected, targets := np.FromClaims(claims)
+	result.Ports = expected
+
+	namer, err := np.NewNamedPort(context.Background(), conf)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	status, err := namer.ResyncNamedPorts(context.Background(), expected, targets, np.Owners(claims))
+	result.Status = status
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// printSyncResults displays the instance groups having each expected port
+func printSyncResults(w io.Writer, results []clusterSync, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+
+	for _, result := range results {
+		fmt.Fprintf(w, "Cluster %s:\n", result.Cluster)
+
+		var names []string
+		for name := range result.Ports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			igs := "none"
+			if len(result.Status[name]) > 0 {
+				sorted := append([]string{}, result.Status[name]...)
+				sort.Strings(sorted)
+				igs = strings.Join(sorted, ", ")
+			}
+			fmt.Fprintf(w, "  %s (%d): %s\n", name, result.Ports[name], igs)
+		}
+
+		if result.Error != "" {
+			fmt.Fprintf(w, "  Error: %s\n", result.Error)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+func TestPrintSyncResults(t *testing.T) {
+	results := []clusterSync{
+		{
+			Cluster: "foo",
+			Ports:   np.PortList{"http": 8080, "gpu": 9090},
+			Status:  np.SyncStatus{"http": {"ig-b", "ig-a"}},
+		},
+		{Cluster: "bar", Error: "could not find cluster zone"},
+	}
+
+	var buf bytes.Buffer
+	if err := printSyncResults(&buf, results, "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		"Cluster foo:\n  gpu (9090): none\n  http (8080): ig-a, ig-b\n",
+		"Cluster bar:\n  Error: could not find cluster zone\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Sync results lack %q:\n%s", expected, out)
+		}
+	}
+
+	buf.Reset()
+	if err := printSyncResults(&buf, results, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []clusterSync
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid json sync results: %v", err)
+	}
+	if len(decoded) != 2 || decoded[1].Error == "" {
+		t.Errorf("Unexpected json sync results: %+v", decoded)
+	}
+}
+
+func TestSyncCmdFormat(t *testing.T) {
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs([]string{"sync", "--format", "yaml"})
+	if err := Execute(); err == nil {
+		t.Error("sync should fail with an unknown output format")
+	}
+	syncFormat = "text"
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	"github.com/bpineau/kube-named-ports/pkg/crd"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/services"
+)
+
+var (
+	validateFiles []string
+
+	validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Validate named ports declarations in manifests files",
+		Long: "Parse Service (and NamedPort) manifests from files, directories, or stdin (\"-\"),\n" +
+			"and check their named ports declarations as the controller would, without\n" +
+			"connecting to any cluster. Conflicting values for a same port name are reported too.\n" +
+			"Exits with status 2 when problems are found.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(validateFiles) == 0 {
+				return fmt.Errorf("No manifest provided (use -f)")
+			}
+
+			problems, err := validateManifests(cmd.OutOrStdout(), cmd.InOrStdin(), validateFiles)
+			if err != nil {
+				return err
+			}
+
+			if problems > 0 {
+				return findingsf("Found %d invalid named ports declarations", problems)
+			}
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	validateCmd.Flags().StringSliceVarP(&validateFiles, "filename", "f", nil,
+		"manifests files or directories to validate (\"-\" for stdin)")
+	RootCmd.AddCommand(validateCmd)
+}
+
+// validateManifests checks the provided manifests, reports problems to w,
+// and returns the number of problems found.
+func validateManifests(w io.Writer, stdin io.Reader, paths []string) (int, error) {
+	var (
+		problems int
+		claims   []np.Claim
+	)
+
+	report := func(source string, err error) {
+		problems++
+		fmt.Fprintf(w, "%s: %v\n", source, err)
+	}
+
+	files, err := manifestsFiles(paths)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		docs, err := readDocuments(file, stdin)
+		if err != nil {
+			report(file, err)
+		}
+
+		for _, doc := range docs {
+			objClaims, source, errs := validateDocument(doc)
+			for _, err := range errs {
+				report(file+": "+source, err)
+			}
+			claims = append(claims, objClaims...)
+		}
+	}
+
+	conflicts := np.Conflicts(claims)
+	names := make([]string, 0, len(conflicts))
+	for name := range conflicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var decls []string
+		for _, claim := range conflicts[name] {
+			decls = append(decls, fmt.Sprintf("%s=%d", claim.Owner, claim.Port))
+		}
+		report("conflict", fmt.Errorf("named port %q declared with distinct values: %s",
+			name, strings.Join(decls, ", ")))
+	}
+
+	return problems, nil
+}
+
+// readDocuments splits a file (or stdin, for "-") into yaml documents. The
+// documents read before an error are returned along with it.
+func readDocuments(file string, stdin io.Reader) ([][]byte, error) {
+	var docs [][]byte
+
+	in := stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open manifest: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return docs, fmt.Errorf("failed to read manifest: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// validateDocument checks a single yaml (or json) document. Objects other than
+// Services and NamedPorts are ignored.
+func validateDocument(doc []byte) ([]np.Claim, string, []error) {
+	data, err := yaml.YAMLToJSON(doc)
+	if err != nil {
+		return nil, "", []error{fmt.Errorf("invalid yaml: %v", err)}
+	}
+
+	if strings.TrimSpace(string(data)) == "null" {
+		return nil, "", nil
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err = obj.UnmarshalJSON(data); err != nil {
+		return nil, "", []error{fmt.Errorf("invalid manifest: %v", err)}
+	}
+
+	source := obj.GetKind() + " " + obj.GetName()
+	if obj.GetNamespace() != "" {
+		source = obj.GetKind() + " " + obj.GetNamespace() + "/" + obj.GetName()
+	}
+
+	gvk := obj.GroupVersionKind()
+	switch {
+	case gvk.Group == "" && gvk.Kind == "Service":
+		svc := &core_v1.Service{}
+		if err = json.Unmarshal(data, svc); err != nil {
+			return nil, source, []error{fmt.Errorf("invalid service: %v", err)}
+		}
+		if svc.Namespace == "" {
+			svc.Namespace = "default"
+		}
+
+		errs := services.CheckAnnotations(svc)
+		claims, err := services.ServiceClaims(svc)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return claims, source, errs
+
+	case gvk.Group == crd.NamedPortResource.Group && gvk.Kind == "NamedPort":
+		claim, err := crd.ObjectClaim(obj)
+		if err != nil {
+			return nil, source, []error{err}
+		}
+		return []np.Claim{claim}, source, nil
+	}
+
+	return nil, source, nil
+}
+
+// manifestsFiles expands directories into the yaml and json files they contain
+func manifestsFiles(paths []string) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		if path == "-" {
+			files = append(files, path)
+			continue
+		}
+
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			// explicitly provided files are always considered
+			switch filepath.Ext(file) {
+			case ".yaml", ".yml", ".json":
+				files = append(files, file)
+			default:
+				if file == path {
+					files = append(files, file)
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validManifests = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+  annotations:
+    kube-named-ports.io/port-name: http
+    kube-named-ports.io/port-value: "8080"
+---
+apiVersion: kube-named-ports.io/v1alpha1
+kind: NamedPort
+metadata:
+  name: metrics
+spec:
+  name: metrics
+  port: 9100
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+`
+
+const invalidManifests = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: broken
+  annotations:
+    kube-named-ports.io/port-map: '{"foo": 1234'
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: toobig
+  annotations:
+    kube-named-ports.io/port-map: '{"foo": 70000}'
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: other
+  annotations:
+    kube-named-ports.io/port-name: http
+    kube-named-ports.io/port-value: "8081"
+    kube-named-ports.io/node-pool: "typo"
+`
+
+func TestValidateManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knp-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "valid.yaml"), []byte(validManifests), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a manifest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	problems, err := validateManifests(&buf, nil, []string{dir})
+	if err != nil || problems != 0 {
+		t.Fatalf("Valid manifests reported as invalid (%v):\n%s", err, buf.String())
+	}
+
+	buf.Reset()
+	stdin := strings.NewReader(invalidManifests)
+	problems, err = validateManifests(&buf, stdin, []string{dir, "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if problems != 4 {
+		t.Errorf("Expected 4 problems, got %d:\n%s", problems, out)
+	}
+	for _, expected := range []string{
+		"Service broken: Failed to unmarshal port-map",
+		"Service toobig: invalid port value",
+		`unknown annotation "kube-named-ports.io/node-pool"`,
+		"service/default/other=8081, service/prod/web=8080",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in validate output:\n%s", expected, out)
+		}
+	}
+}
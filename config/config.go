@@ -2,17 +2,25 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/bpineau/kube-named-ports/pkg/audit"
 	"github.com/bpineau/kube-named-ports/pkg/clientset"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
 // KnpConfig is the configuration struct, passed to controllers's Init()
 type KnpConfig struct {
-	// When DryRun is true, we display but don't really send notifications
+	// When DryRun is true, we display but don't really send notifications.
+	// Can be changed by a configuration reload: use IsDryRun() at runtime.
 	DryRun bool
 
 	// Logger should be used to send all logs
@@ -21,13 +29,34 @@ type KnpConfig struct {
 	// ClientSet represents a connection to a Kubernetes cluster
 	ClientSet kubernetes.Interface
 
+	// KubeContext is the optional kubeconfig context used to build the clients
+	KubeContext string
+
+	// DynClient is a dynamic client, used to watch our custom resources
+	DynClient dynamic.Interface
+
+	// NamedPortCRD enables the NamedPort custom resources controller
+	NamedPortCRD bool
+
 	// HealthPort is the facultative healthcheck port
 	HealthPort int
 
 	// ResyncIntv define the duration between full resync. Set to 0 to disable resyncs.
+	// Can be changed by a configuration reload: use ResyncInterval() at runtime.
 	ResyncIntv time.Duration
 
-	// Cluster is the name of the cluster we'll operate on. Mandatory.
+	// Namespaces restricts the watched services to those namespaces (all when empty).
+	// Can be changed by a configuration reload: use WatchesNamespace() at runtime.
+	Namespaces []string
+
+	// ExcludeNamespaces lists namespaces whose services are ignored.
+	// Can be changed by a configuration reload: use WatchesNamespace() at runtime.
+	ExcludeNamespaces []string
+
+	// ShutdownGrace is how long we wait, on shutdown, for an ongoing resync to complete
+	ShutdownGrace time.Duration
+
+	// Cluster is the name of the cluster we'll operate on. Mandatory with "gke" discovery.
 	Cluster string
 
 	// Zone is the cluster's zone. Can be guessed if not provided.
@@ -35,25 +64,302 @@ type KnpConfig struct {
 
 	// Project is the cluster's project. Can be guessed from host's metadata if not provided.
 	Project string
+
+	// Discovery is the instance groups discovery mode: "gke" (node pools API) or "nodes" (Kubernetes nodes)
+	Discovery string
+
+	// CredentialsFile is an optional GCP credentials file (service account key or others)
+	CredentialsFile string
+
+	// WorkloadIdentity use the metadata server (ie. GKE Workload Identity) credentials
+	WorkloadIdentity bool
+
+	// ImpersonateServiceAccount is an optional service account impersonated for all GCP calls
+	ImpersonateServiceAccount string
+
+	// ImpersonateDelegates is an optional chain of service accounts used to impersonate ImpersonateServiceAccount
+	ImpersonateDelegates []string
+
+	// WriteServiceAccount is an optional service account impersonated to update named ports
+	WriteServiceAccount string
+
+	// GCPTimeout bounds each GCP API call (no limit when 0)
+	GCPTimeout time.Duration
+
+	// GCPRateLimit is the maximum GCP API calls rate, per second and project (no limit when 0)
+	GCPRateLimit float64
+
+	// GCPBurst is the number of GCP API calls allowed in a burst, above the rate limit
+	GCPBurst int
+
+	// GCPMaxRetries is how many times rate limited or failing (5xx) GCP calls are retried
+	GCPMaxRetries int
+
+	// UnmanagedGroups is a regexp matching unmanaged instance groups names we should also handle
+	UnmanagedGroups string
+
+	// AuditSink is where named ports changes are audited: "stdout" (on stderr), "file:<path>" or "events" (empty to disable)
+	AuditSink string
+
+	// Auditor receives the named ports changes audit records, when auditing is enabled
+	Auditor audit.Sink
+
+	// TraceEndpoint is where spans are exported: "stdout" (on stderr) or an OTLP/HTTP collector url (empty to disable)
+	TraceEndpoint string
+
+	// reloadHooks are called after configuration reloads
+	reloadHooks []func()
+}
+
+// ClusterConfig describes a cluster, when managing several clusters
+type ClusterConfig struct {
+	// Name is the cluster's name
+	Name string `mapstructure:"name"`
+
+	// Zone is the cluster's zone. Can be guessed if not provided.
+	Zone string `mapstructure:"zone"`
+
+	// Project is the cluster's project. Defaults to the global project.
+	Project string `mapstructure:"project"`
+
+	// Discovery is the instance groups discovery mode. Defaults to the global mode.
+	Discovery string `mapstructure:"discovery"`
+
+	// UnmanagedGroups is the unmanaged instance groups regexp. Defaults to the global regexp.
+	UnmanagedGroups string `mapstructure:"unmanaged-groups"`
+
+	// APIServer is the cluster's api-server url. Defaults to the global url.
+	APIServer string `mapstructure:"api-server"`
+
+	// KubeConfig is the cluster's kubeconfig path. Defaults to the global path.
+	KubeConfig string `mapstructure:"kube-config"`
+
+	// KubeContext is the cluster's kubeconfig context.
+	KubeContext string `mapstructure:"kube-context"`
+}
+
+// ForCluster returns a copy of the configuration bound to the provided cluster.
+// The copy has no Kubernetes clients (they should be initialized with Init()), nor auditor.
+func (c *KnpConfig) ForCluster(cl ClusterConfig) *KnpConfig {
+	conf := *c
+	conf.ClientSet = nil
+	conf.DynClient = nil
+	conf.Auditor = nil
+	conf.reloadHooks = nil
+	conf.Cluster = cl.Name
+	conf.Zone = cl.Zone
+	conf.KubeContext = cl.KubeContext
+
+	if cl.Project != "" {
+		conf.Project = cl.Project
+	}
+	if cl.Discovery != "" {
+		conf.Discovery = cl.Discovery
+	}
+	if cl.UnmanagedGroups != "" {
+		conf.UnmanagedGroups = cl.UnmanagedGroups
+	}
+
+	return &conf
+}
+
+// Validate checks the configuration settings are consistent and usable,
+// reporting all the issues found.
+func (c *KnpConfig) Validate() error {
+	dyn := &Dynamic{ResyncIntv: c.ResyncIntv, Namespaces: c.Namespaces, ExcludeNamespaces: c.ExcludeNamespaces}
+	errs := dyn.errors()
+
+	if c.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Sprintf("shutdown grace period can't be negative (got %v)", c.ShutdownGrace))
+	}
+
+	if c.GCPTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("GCP calls timeout can't be negative (got %v)", c.GCPTimeout))
+	}
+
+	if c.GCPRateLimit < 0 {
+		errs = append(errs, fmt.Sprintf("GCP calls rate limit can't be negative (got %v)", c.GCPRateLimit))
+	} else if c.GCPRateLimit > 0 && c.GCPBurst < 1 {
+		errs = append(errs, fmt.Sprintf("GCP calls burst must be at least 1 when rate limiting (got %d)", c.GCPBurst))
+	}
+
+	if c.GCPMaxRetries < 0 {
+		errs = append(errs, fmt.Sprintf("GCP calls max retries can't be negative (got %d)", c.GCPMaxRetries))
+	}
+
+	if c.HealthPort < 0 || c.HealthPort > 65535 {
+		errs = append(errs, fmt.Sprintf("healthcheck port %d is out of the 0-65535 range", c.HealthPort))
+	}
+
+	// as in namedports.DiscoveryGKE and namedports.DiscoveryNodes
+	switch c.Discovery {
+	case "gke":
+		if c.Cluster == "" {
+			errs = append(errs, "cluster name must be specified with gke discovery")
+		}
+	case "nodes":
+	default:
+		errs = append(errs, fmt.Sprintf("unknown discovery mode %q (should be gke or nodes)", c.Discovery))
+	}
+
+	if _, err := regexp.Compile(c.UnmanagedGroups); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid unmanaged instance groups pattern: %v", err))
+	}
+
+	if err := audit.CheckSink(c.AuditSink); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if err := tracing.CheckEndpoint(c.TraceEndpoint); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.CredentialsFile != "" && c.WorkloadIdentity {
+		errs = append(errs, "credentials file and workload identity are mutually exclusive")
+	}
+
+	if c.ImpersonateServiceAccount == "" && len(c.ImpersonateDelegates) > 0 {
+		errs = append(errs, "impersonation delegates require a service account to impersonate")
+	}
+
+	return joinErrors(errs)
+}
+
+// joinErrors returns an error holding all the messages, or nil
+func joinErrors(errs []string) error {
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // Init initialize the configuration's ClientSet
 func (c *KnpConfig) Init(apiserver string, kubeconfig string) error {
+	if err := c.NewClients(apiserver, kubeconfig); err != nil {
+		return err
+	}
+
+	// better fail early, if we can't talk to the cluster's api
+	_, err := c.ClientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to query Kubernetes api-server: %+v", err)
+	}
+
+	c.Logger.Info("Kubernetes clientset initialized")
+	return nil
+}
+
+// NewClients builds the Kubernetes clients, without contacting the api-server
+func (c *KnpConfig) NewClients(apiserver string, kubeconfig string) error {
 	var err error
 
 	if c.ClientSet == nil {
-		c.ClientSet, err = clientset.NewClientSet(apiserver, kubeconfig)
+		c.ClientSet, err = clientset.NewClientSet(apiserver, kubeconfig, c.KubeContext)
 		if err != nil {
 			return fmt.Errorf("Failed init Kubernetes clientset: %+v", err)
 		}
 	}
 
-	// better fail early, if we can't talk to the cluster's api
-	_, err = c.ClientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
-	if err != nil {
-		return fmt.Errorf("Failed to query Kubernetes api-server: %+v", err)
+	if c.DynClient == nil {
+		c.DynClient, err = clientset.NewDynamicClient(apiserver, kubeconfig, c.KubeContext)
+		if err != nil {
+			return fmt.Errorf("Failed init Kubernetes dynamic client: %+v", err)
+		}
 	}
 
-	c.Logger.Info("Kubernetes clientset initialized")
 	return nil
 }
+
+// dynamicLock guards the settings that can be changed by a configuration reload
+var dynamicLock sync.RWMutex
+
+// Dynamic holds the settings that can be changed at runtime, by a configuration reload
+type Dynamic struct {
+	LogLevel          logrus.Level
+	DryRun            bool
+	ResyncIntv        time.Duration
+	Namespaces        []string
+	ExcludeNamespaces []string
+}
+
+// Validate checks the dynamic settings are usable
+func (d *Dynamic) Validate() error {
+	return joinErrors(d.errors())
+}
+
+func (d *Dynamic) errors() []string {
+	var errs []string
+
+	if d.ResyncIntv < 0 {
+		errs = append(errs, fmt.Sprintf("resync interval can't be negative (got %v)", d.ResyncIntv))
+	}
+
+	for _, ns := range append(append([]string{}, d.Namespaces...), d.ExcludeNamespaces...) {
+		if msgs := validation.IsDNS1123Label(ns); len(msgs) > 0 {
+			errs = append(errs, fmt.Sprintf("invalid namespace %q: %s", ns, strings.Join(msgs, ", ")))
+		}
+	}
+
+	return errs
+}
+
+// Reload applies new dynamic settings, then calls the functions registered with OnReload
+func (c *KnpConfig) Reload(d Dynamic) {
+	dynamicLock.Lock()
+	c.DryRun = d.DryRun
+	c.ResyncIntv = d.ResyncIntv
+	c.Namespaces = d.Namespaces
+	c.ExcludeNamespaces = d.ExcludeNamespaces
+	c.Logger.SetLevel(d.LogLevel)
+	hooks := c.reloadHooks
+	dynamicLock.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// OnReload registers a function to call after each configuration reload
+func (c *KnpConfig) OnReload(fn func()) {
+	dynamicLock.Lock()
+	defer dynamicLock.Unlock()
+	c.reloadHooks = append(c.reloadHooks, fn)
+}
+
+// IsDryRun tells if we should only display the changes we would make
+func (c *KnpConfig) IsDryRun() bool {
+	dynamicLock.RLock()
+	defer dynamicLock.RUnlock()
+	return c.DryRun
+}
+
+// ResyncInterval returns the duration between full resyncs (0 when disabled)
+func (c *KnpConfig) ResyncInterval() time.Duration {
+	dynamicLock.RLock()
+	defer dynamicLock.RUnlock()
+	return c.ResyncIntv
+}
+
+// WatchesNamespace tells if the services of a namespace should be considered
+func (c *KnpConfig) WatchesNamespace(namespace string) bool {
+	dynamicLock.RLock()
+	defer dynamicLock.RUnlock()
+
+	for _, ns := range c.ExcludeNamespaces {
+		if ns == namespace {
+			return false
+		}
+	}
+
+	if len(c.Namespaces) == 0 {
+		return true
+	}
+
+	for _, ns := range c.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,7 +3,11 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 const nonExistentPath = "\\/hopefully/non/existent/path"
@@ -45,3 +49,63 @@ func TestConfig(t *testing.T) {
 		t.Fatal("conf.Init() should fail on non existent kubeconfig path")
 	}
 }
+
+func TestReload(t *testing.T) {
+	conf := FakeConfig()
+	conf.ExcludeNamespaces = []string{"kube-system"}
+
+	if conf.WatchesNamespace("kube-system") || !conf.WatchesNamespace("default") {
+		t.Error("WatchesNamespace should only ignore excluded namespaces")
+	}
+
+	reloads := 0
+	conf.OnReload(func() { reloads++ })
+
+	conf.Reload(Dynamic{
+		LogLevel:          logrus.WarnLevel,
+		ResyncIntv:        time.Minute,
+		Namespaces:        []string{"default", "kube-system"},
+		ExcludeNamespaces: []string{"kube-system"},
+	})
+
+	if reloads != 1 {
+		t.Errorf("OnReload functions should be called once per reload, got %d calls", reloads)
+	}
+	if conf.IsDryRun() || conf.ResyncInterval() != time.Minute || conf.Logger.GetLevel() != logrus.WarnLevel {
+		t.Errorf("Reload didn't apply the new settings: %+v", conf)
+	}
+	if !conf.WatchesNamespace("default") || conf.WatchesNamespace("kube-system") || conf.WatchesNamespace("other") {
+		t.Error("WatchesNamespace should honor the reloaded namespaces filters")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	conf := FakeConfig()
+	conf.Cluster, conf.Discovery = "foo", "gke"
+	if err := conf.Validate(); err != nil {
+		t.Errorf("FakeConfig() should be valid: %v", err)
+	}
+
+	conf.ResyncIntv = -time.Second
+	conf.HealthPort = 70000
+	conf.ShutdownGrace = -time.Second
+	conf.GCPTimeout = -time.Second
+	conf.GCPRateLimit = 10
+	conf.GCPMaxRetries = -1
+	conf.Discovery = "gce"
+	conf.UnmanagedGroups = "gke-("
+	conf.AuditSink = "file:"
+	conf.TraceEndpoint = "localhost:4318"
+	conf.CredentialsFile = "/etc/gcp.json"
+	conf.WorkloadIdentity = true
+	conf.ImpersonateDelegates = []string{"sa@foo.iam.gserviceaccount.com"}
+	conf.ExcludeNamespaces = []string{"Kube_System"}
+
+	err := conf.Validate()
+	if err == nil {
+		t.Fatal("Validate() should fail on invalid settings")
+	}
+	if n := len(strings.Split(err.Error(), "; ")); n != 13 {
+		t.Errorf("Validate() should report all issues, got %d: %v", n, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	fakedyn "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
 
 	"github.com/bpineau/kube-named-ports/pkg/log"
@@ -19,10 +20,14 @@ var (
 
 // FakeConfig returns a configuration struct using a fake clientset, for unit tests
 func FakeConfig(objects ...runtime.Object) *KnpConfig {
+	// the test output can't fail
+	logger, _ := log.New("", "", "test", "")
+
 	c := &KnpConfig{
 		DryRun:     true,
-		Logger:     log.New("", "", "test"),
+		Logger:     logger,
 		ClientSet:  fake.NewSimpleClientset(objects...),
+		DynClient:  FakeDynClient(),
 		ResyncIntv: FakeResyncInterval,
 	}
 
@@ -33,3 +38,8 @@ func FakeConfig(objects ...runtime.Object) *KnpConfig {
 func FakeClientSet() *fake.Clientset {
 	return fake.NewSimpleClientset()
 }
+
+// FakeDynClient provides a fake dynamic client, preloaded with the provided objects
+func FakeDynClient(objects ...runtime.Object) *fakedyn.FakeDynamicClient {
+	return fakedyn.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+}
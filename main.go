@@ -1,13 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/bpineau/kube-named-ports/cmd"
 )
 
-//var privateExitHandler func(code int) = os.Exit
+// var privateExitHandler func(code int) = os.Exit
 var privateExitHandler = os.Exit
 
 // ExitWrapper allow unit tests on main() exit values
@@ -17,7 +18,11 @@ func ExitWrapper(exit int) {
 
 func main() {
 	if err := cmd.Execute(); err != nil {
-		fmt.Printf("%+v", err)
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		if errors.Is(err, cmd.ErrFindings) {
+			ExitWrapper(2)
+			return
+		}
 		ExitWrapper(1)
 	}
 }
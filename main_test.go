@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/bpineau/kube-named-ports/cmd"
@@ -34,6 +36,43 @@ func TestMain(t *testing.T) {
 	}
 }
 
+func TestMainExitCodes(t *testing.T) {
+	var code int
+	privateExitHandler = func(c int) {
+		code = c
+	}
+
+	cmd.RootCmd.SetOutput(new(bytes.Buffer))
+
+	manifest, err := ioutil.TempFile("", "knp-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(manifest.Name())
+
+	_, err = manifest.WriteString("apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n" +
+		"  annotations:\n    kube-named-ports.io/port-map: '{\"foo\": 70000}'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Close()
+
+	// findings are reported with a distinct exit status
+	cmd.RootCmd.SetArgs([]string{"validate", "-f", manifest.Name()})
+	main()
+	if code != 2 {
+		t.Errorf("main() should exit with status 2 on findings, got %d", code)
+	}
+
+	// failures to run the command exit with status 1
+	code = 0
+	cmd.RootCmd.SetArgs([]string{"validate", "-f", "/does/not/exist.yaml"})
+	main()
+	if code != 1 {
+		t.Errorf("main() should exit with status 1 on failures, got %d", code)
+	}
+}
+
 func TestExitWrapper(t *testing.T) {
 	var ok = false
 
@@ -0,0 +1,240 @@
+// Package audit records the named ports changes made to GCP instance groups.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	filePrefix = "file:"
+
+	eventsComponent = "kube-named-ports"
+)
+
+// namedPortResource identifies the NamedPort custom resources (as crd.NamedPortResource,
+// which we can't import: the crd package depends on us through namedports)
+var namedPortResource = schema.GroupVersionResource{
+	Group:    "kube-named-ports.io",
+	Version:  "v1alpha1",
+	Resource: "namedports",
+}
+
+// Record describes a named ports change on an instance group
+type Record struct {
+	// Time is the change time
+	Time time.Time `json:"time"`
+
+	// Cluster is the cluster owning the instance group
+	Cluster string `json:"cluster"`
+
+	Project       string `json:"project"`
+	Zone          string `json:"zone"`
+	InstanceGroup string `json:"instanceGroup"`
+
+	// Before and After are the instance group named ports, before and after the change
+	Before map[string]int64 `json:"before"`
+	After  map[string]int64 `json:"after"`
+
+	// Owners lists the objects declaring the changed ports, ie. "service/<namespace>/<name>"
+	Owners []string `json:"owners"`
+
+	// DryRun tells the change wasn't really applied
+	DryRun bool `json:"dryRun"`
+
+	// Error is the change failure, if any
+	Error string `json:"error,omitempty"`
+}
+
+// Sink receives audit records
+type Sink interface {
+	Record(rec *Record) error
+}
+
+// NewSink returns an audit sink, given as "stdout" (json lines, written to stderr
+// so they don't mix with commands' json output), "file:<path>"
+// (json lines, appended to the file), or "events" (Kubernetes Events on the
+// owners objects). An empty sink disables auditing, and returns nil.
+func NewSink(sink string, clientset kubernetes.Interface, dynClient dynamic.Interface) (Sink, error) {
+	if err := CheckSink(sink); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case sink == "stdout":
+		return &writerSink{w: os.Stderr}, nil
+	case strings.HasPrefix(sink, filePrefix):
+		f, err := os.OpenFile(strings.TrimPrefix(sink, filePrefix), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %v", err)
+		}
+		return &writerSink{w: f}, nil
+	case sink == "events":
+		if clientset == nil {
+			return nil, fmt.Errorf("events audit sink needs Kubernetes access")
+		}
+		return &eventsSink{clientset: clientset, dynClient: dynClient}, nil
+	}
+
+	return nil, nil
+}
+
+// CheckSink validates an audit sink specification, without opening the sink
+func CheckSink(sink string) error {
+	switch {
+	case sink == "", sink == "stdout", sink == "events":
+		return nil
+	case strings.HasPrefix(sink, filePrefix):
+		if strings.TrimPrefix(sink, filePrefix) == "" {
+			return fmt.Errorf("audit file sink needs a path (ie. file:/var/log/kube-named-ports-audit.log)")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown audit sink %q (should be stdout, file:<path> or events)", sink)
+}
+
+// writerSink writes records as json lines
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Record implements Sink
+func (s *writerSink) Record(rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// eventsSink creates a Kubernetes Event on each record's owner object
+type eventsSink struct {
+	clientset kubernetes.Interface
+	dynClient dynamic.Interface
+}
+
+// Record implements Sink
+func (s *eventsSink) Record(rec *Record) error {
+	reason, kind := "NamedPortsUpdated", core_v1.EventTypeNormal
+	if rec.DryRun {
+		reason = "NamedPortsUpdateDryRun"
+	}
+	if rec.Error != "" {
+		reason, kind = "NamedPortsUpdateFailed", core_v1.EventTypeWarning
+	}
+
+	msg := fmt.Sprintf("Instance group %s (project %s, zone %s) named ports: %s -> %s",
+		rec.InstanceGroup, rec.Project, rec.Zone, formatPorts(rec.Before), formatPorts(rec.After))
+	if rec.Error != "" {
+		msg += ": " + rec.Error
+	}
+
+	var errs []string
+	for _, owner := range rec.Owners {
+		ref, ok := ownerReference(owner)
+		if !ok {
+			continue
+		}
+		ref.UID = s.uid(ref)
+
+		// events on cluster scoped objects (NamedPorts) go to the default namespace
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = meta_v1.NamespaceDefault
+		}
+
+		event := &core_v1.Event{
+			ObjectMeta: meta_v1.ObjectMeta{
+				// named as client-go's events recorder does
+				Name:      fmt.Sprintf("%v.%x", ref.Name, time.Now().UnixNano()),
+				Namespace: namespace,
+			},
+			InvolvedObject: ref,
+			Reason:         reason,
+			Message:        msg,
+			Type:           kind,
+			Source:         core_v1.EventSource{Component: eventsComponent},
+			FirstTimestamp: meta_v1.NewTime(rec.Time),
+			LastTimestamp:  meta_v1.NewTime(rec.Time),
+			Count:          1,
+		}
+
+		if _, err := s.clientset.CoreV1().Events(namespace).Create(event); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", owner, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to create audit events: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// uid looks up the owner object's UID, so events are tied to that object
+// instance. Owners that can't be found (ie. deleted since) get no UID.
+func (s *eventsSink) uid(ref core_v1.ObjectReference) types.UID {
+	switch ref.Kind {
+	case "Service":
+		svc, err := s.clientset.CoreV1().Services(ref.Namespace).Get(ref.Name, meta_v1.GetOptions{})
+		if err == nil {
+			return svc.UID
+		}
+	case "NamedPort":
+		if s.dynClient == nil {
+			return ""
+		}
+		obj, err := s.dynClient.Resource(namedPortResource).Get(ref.Name, meta_v1.GetOptions{})
+		if err == nil {
+			return obj.GetUID()
+		}
+	}
+	return ""
+}
+
+// ownerReference returns the object reference of a "service/<namespace>/<name>"
+// or "namedport/<name>" (cluster scoped) owner.
+func ownerReference(owner string) (core_v1.ObjectReference, bool) {
+	elm := strings.Split(owner, "/")
+	switch {
+	case len(elm) == 3 && elm[0] == "service":
+		return core_v1.ObjectReference{APIVersion: "v1", Kind: "Service", Namespace: elm[1], Name: elm[2]}, true
+	case len(elm) == 2 && elm[0] == "namedport":
+		return core_v1.ObjectReference{
+			APIVersion: namedPortResource.GroupVersion().String(),
+			Kind:       "NamedPort",
+			Name:       elm[1],
+		}, true
+	}
+	return core_v1.ObjectReference{}, false
+}
+
+// formatPorts displays ports as a sorted "name:port" list
+func formatPorts(ports map[string]int64) string {
+	var list []string
+	for name, port := range ports {
+		list = append(list, fmt.Sprintf("%s:%d", name, port))
+	}
+	sort.Strings(list)
+	return "[" + strings.Join(list, " ") + "]"
+}
@@ -0,0 +1,131 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedyn "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testRecord = &Record{
+	Time:          time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC),
+	Cluster:       "foo",
+	Project:       "my-project",
+	Zone:          "europe-west1-b",
+	InstanceGroup: "gke-foo-default-pool-1234abcd-grp",
+	Before:        map[string]int64{"legacy": 1234},
+	After:         map[string]int64{"legacy": 1234, "http": 8080},
+	Owners:        []string{"service/default/web", "namedport/http", "unknown"},
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knp-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	for i := 0; i < 2; i++ {
+		sink, err := NewSink("file:"+path, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sink.Record(testRecord); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Audit file should be appended to:\n%s", content)
+	}
+
+	var rec Record
+	if err = json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatalf("Audit records should be json: %v", err)
+	}
+	if rec.InstanceGroup != testRecord.InstanceGroup || rec.After["http"] != 8080 || rec.DryRun {
+		t.Errorf("Unexpected audit record: %+v", rec)
+	}
+}
+
+func TestEventsSink(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&core_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"},
+	})
+
+	namedport := &unstructured.Unstructured{}
+	namedport.SetAPIVersion("kube-named-ports.io/v1alpha1")
+	namedport.SetKind("NamedPort")
+	namedport.SetName("http")
+	namedport.SetUID("http-uid")
+
+	sink, err := NewSink("events", clientset, fakedyn.NewSimpleDynamicClient(runtime.NewScheme(), namedport))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sink.Record(testRecord); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := clientset.CoreV1().Events("default").List(meta_v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events.Items) != 2 {
+		t.Fatalf("Expected an event per known owner, got %d", len(events.Items))
+	}
+
+	for _, event := range events.Items {
+		if event.Reason != "NamedPortsUpdated" ||
+			!strings.Contains(event.Message, "[legacy:1234] -> [http:8080 legacy:1234]") {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+
+		obj := event.InvolvedObject
+		switch obj.Kind {
+		case "Service":
+			if obj.Namespace != "default" || obj.UID != "web-uid" {
+				t.Errorf("Unexpected service reference: %+v", obj)
+			}
+		case "NamedPort":
+			if obj.Namespace != "" || obj.UID != "http-uid" {
+				t.Errorf("Cluster scoped NamedPorts references shouldn't have a namespace: %+v", obj)
+			}
+		}
+	}
+}
+
+func TestNewSinkErrors(t *testing.T) {
+	if sink, err := NewSink("", nil, nil); sink != nil || err != nil {
+		t.Errorf("An empty sink should disable auditing")
+	}
+
+	if sink, err := NewSink("stdout", nil, nil); err != nil || sink.(*writerSink).w != os.Stderr {
+		t.Errorf("stdout records should be written to stderr: %v", err)
+	}
+
+	for _, spec := range []string{"file:", "events", "syslog"} {
+		if _, err := NewSink(spec, nil, nil); err == nil {
+			t.Errorf("NewSink should fail with %q", spec)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -15,7 +16,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
-func buildConfig(apiserver string, kubeconfig string) (*rest.Config, error) {
+func buildConfig(apiserver string, kubeconfig string, kubecontext string) (*rest.Config, error) {
 	if kubeconfig == "" {
 		if home := homedir.HomeDir(); home != "" {
 			if _, err := os.Stat(filepath.Join(home, ".kube", "config")); err == nil {
@@ -24,6 +25,13 @@ func buildConfig(apiserver string, kubeconfig string) (*rest.Config, error) {
 		}
 	}
 
+	if kubecontext != "" {
+		rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: kubecontext}
+		overrides.ClusterInfo.Server = apiserver
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+
 	if apiserver != "" || kubeconfig != "" {
 		return clientcmd.BuildConfigFromFlags(apiserver, kubeconfig)
 	}
@@ -32,13 +40,24 @@ func buildConfig(apiserver string, kubeconfig string) (*rest.Config, error) {
 }
 
 // NewClientSet create a clientset (a client connection to a Kubernetes cluster).
-// It will connect using the optional apiserver or kubeconfig options, or will
-// default to the automatic, in cluster settings.
-func NewClientSet(apiserver string, kubeconfig string) (*kubernetes.Clientset, error) {
-	config, err := buildConfig(apiserver, kubeconfig)
+// It will connect using the optional apiserver, kubeconfig, and kubeconfig's
+// context options, or will default to the automatic, in cluster settings.
+func NewClientSet(apiserver string, kubeconfig string, kubecontext string) (*kubernetes.Clientset, error) {
+	config, err := buildConfig(apiserver, kubeconfig, kubecontext)
 	if err != nil {
 		return nil, err
 	}
 
 	return kubernetes.NewForConfig(config)
 }
+
+// NewDynamicClient create a dynamic client, used to access custom resources.
+// It accepts the same connection options as NewClientSet.
+func NewDynamicClient(apiserver string, kubeconfig string, kubecontext string) (dynamic.Interface, error) {
+	config, err := buildConfig(apiserver, kubeconfig, kubecontext)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(config)
+}
@@ -11,7 +11,7 @@ const nonExistentPath = "\\/hopefully/non/existent/path"
 func TestClientSet(t *testing.T) {
 	here, _ := os.Getwd()
 	_ = os.Setenv("HOME", here+"/../..")
-	cs, err := NewClientSet("", "")
+	cs, err := NewClientSet("", "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -19,19 +19,32 @@ func TestClientSet(t *testing.T) {
 		t.Errorf("NewClientSet() didn't return a *kubernetes.Clientset: %T", cs)
 	}
 
-	cs, _ = NewClientSet("http://127.0.0.1", "/dev/null")
+	cs, _ = NewClientSet("http://127.0.0.1", "/dev/null", "")
 	if fmt.Sprintf("%T", cs) != "*kubernetes.Clientset" {
 		t.Errorf("NewClientSet(server) didn't return a *kubernetes.Clientset: %T", cs)
 	}
 
-	_, err = NewClientSet("http://127.0.0.1", nonExistentPath)
+	_, err = NewClientSet("http://127.0.0.1", nonExistentPath, "")
 	if err == nil {
 		t.Fatal("NewClientSet() should fail on non existent kubeconfig path")
 	}
 
+	cs, err = NewClientSet("", "", "test-fake-server")
+	if err != nil {
+		t.Fatalf("NewClientSet() failed with a kubeconfig context: %v", err)
+	}
+	if fmt.Sprintf("%T", cs) != "*kubernetes.Clientset" {
+		t.Errorf("NewClientSet(context) didn't return a *kubernetes.Clientset: %T", cs)
+	}
+
+	_, err = NewClientSet("", "", "non-existent-context")
+	if err == nil {
+		t.Fatal("NewClientSet() should fail on non existent kubeconfig context")
+	}
+
 	_ = os.Unsetenv("KUBERNETES_SERVICE_HOST")
 	_ = os.Setenv("HOME", nonExistentPath)
-	_, err = NewClientSet("", "")
+	_, err = NewClientSet("", "", "")
 	if err == nil {
 		t.Fatal("NewClientSet() should fail to load InClusterConfig without kube address env")
 	}
@@ -0,0 +1,353 @@
+// Package crd watchs for NamedPort custom resources.
+package crd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
+	"github.com/bpineau/kube-named-ports/pkg/worker"
+
+	"go.opentelemetry.io/otel/attribute"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	maxProcessRetry = 6
+	resyncTick      = time.Second
+)
+
+// Controller watchs NamedPort custom resources, and feeds the worker
+// with the named ports they declare. It doesn't start nor stop the
+// worker, which is owned by the services controller.
+type Controller struct {
+	conf      *config.KnpConfig
+	queue     workqueue.RateLimitingInterface
+	informer  cache.SharedIndexInformer
+	listWatch cache.ListerWatcher
+	stopCh    chan struct{}
+	worker    worker.Worker
+	wg        *sync.WaitGroup
+	initMu    sync.Mutex
+	syncInit  bool
+}
+
+// NewController creates and initialize the NamedPort controller
+func NewController(conf *config.KnpConfig, w worker.Worker) *Controller {
+	c := &Controller{
+		conf:   conf,
+		worker: w,
+	}
+
+	client := c.conf.DynClient.Resource(NamedPortResource)
+	c.listWatch = &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return client.List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return client.Watch(options)
+		},
+	}
+
+	return c
+}
+
+// Start initialize and launch a controller. The sync.WaitGroup
+// argument is expected to be aknowledged (Done()) at controller
+// termination, when Stop() is called.
+func (c *Controller) Start(wg *sync.WaitGroup) {
+	c.conf.Logger.Infof("Starting namedports controller")
+
+	c.stopCh = make(chan struct{})
+
+	c.wg = wg
+
+	c.initMu.Lock()
+	c.syncInit = true
+	c.initMu.Unlock()
+
+	c.startInformer()
+	c.conf.OnReload(c.requeueAll)
+	c.worker.OnSync(c.updateStatus)
+
+	go c.run(c.stopCh)
+
+	<-c.stopCh
+}
+
+// Stop ends a controller and notify the controller's WaitGroup
+func (c *Controller) Stop() {
+	c.conf.Logger.Infof("Stopping namedports controller")
+
+	// don't stop while we're still starting
+	c.initMu.Lock()
+	for !c.syncInit {
+		time.Sleep(time.Millisecond)
+	}
+	c.initMu.Unlock()
+
+	close(c.stopCh)
+	c.wg.Done()
+}
+
+func (c *Controller) startInformer() {
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	c.informer = cache.NewSharedIndexInformer(
+		c.listWatch,
+		&unstructured.Unstructured{},
+		0, // resyncs are handled by resyncLoop, as the interval can be reloaded
+		cache.Indexers{},
+	)
+
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+	})
+}
+
+func (c *Controller) run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	go c.informer.Run(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
+		return
+	}
+
+	c.conf.Logger.Infof("namedports controller synced and ready")
+
+	go c.resyncLoop(stopCh)
+
+	wait.Until(c.runWorker, time.Second, stopCh)
+}
+
+// resyncLoop requeues all NamedPorts once per resync interval. The interval
+// is checked on each tick, as configuration reloads may change it.
+func (c *Controller) resyncLoop(stopCh <-chan struct{}) {
+	last := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(resyncTick):
+		}
+
+		intv := c.conf.ResyncInterval()
+		if intv > 0 && time.Since(last) >= intv {
+			c.requeueAll()
+			last = time.Now()
+		}
+	}
+}
+
+// requeueAll queues all known NamedPorts for processing
+func (c *Controller) requeueAll() {
+	for _, key := range c.informer.GetIndexer().ListKeys() {
+		c.queue.Add(key)
+	}
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+		// continue looping
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	_, span := tracing.Start(context.Background(), "crd.processItem", attribute.String("namedport", key.(string)))
+	err := c.processItem(key.(string))
+	tracing.End(span, err)
+
+	if err == nil {
+		// No error, reset the ratelimit counters
+		c.queue.Forget(key)
+	} else if c.queue.NumRequeues(key) < maxProcessRetry {
+		c.conf.Logger.Errorf("Error processing %s (will retry): %v", key, err)
+		c.queue.AddRateLimited(key)
+	} else {
+		// err != nil and too many retries
+		c.conf.Logger.Errorf("Error processing %s (giving up): %v", key, err)
+		c.queue.Forget(key)
+	}
+
+	return true
+}
+
+func (c *Controller) processItem(key string) error {
+	obj, exist, err := c.informer.GetIndexer().GetByKey(key)
+
+	if err != nil {
+		return fmt.Errorf("Error fetching object with key %s from store: %v", key, err)
+	}
+
+	if !exist {
+		// forget the owner: its ports are no longer expected, but aren't removed from instance groups
+		c.worker.SetOwnedPorts("namedport/"+key, nil)
+		return nil
+	}
+
+	port, err := fromUnstructured(obj)
+	if err != nil {
+		return err
+	}
+
+	target, err := validate(port)
+	if err != nil {
+		return err
+	}
+
+	c.worker.SetTarget("namedport/"+port.Name, port.Spec.Name, target)
+	c.worker.SetOwnedPorts("namedport/"+port.Name, []string{port.Spec.Name})
+	c.worker.Add(port.Spec.Name, port.Spec.Port)
+	return nil
+}
+
+// updateStatus reports, on each NamedPort object, the instance groups
+// where the named port is set.
+func (c *Controller) updateStatus(status np.SyncStatus, _ error) {
+	client := c.conf.DynClient.Resource(NamedPortResource)
+
+	for _, obj := range c.informer.GetStore().List() {
+		port, cerr := fromUnstructured(obj)
+		if cerr != nil {
+			c.conf.Logger.Errorf("Failed to read NamedPort: %v", cerr)
+			continue
+		}
+
+		igs := append([]string{}, status[port.Spec.Name]...)
+		sort.Strings(igs)
+
+		if len(igs) == 0 && len(port.Status.InstanceGroups) == 0 {
+			continue
+		}
+
+		if reflect.DeepEqual(igs, port.Status.InstanceGroups) {
+			continue
+		}
+
+		updated := obj.(*unstructured.Unstructured).DeepCopy()
+		if serr := unstructured.SetNestedStringSlice(updated.Object, igs, "status", "instanceGroups"); serr != nil {
+			c.conf.Logger.Errorf("Failed to set NamedPort %s status: %v", port.Name, serr)
+			continue
+		}
+
+		if _, uerr := client.UpdateStatus(updated, meta_v1.UpdateOptions{}); uerr != nil {
+			c.conf.Logger.Errorf("Failed to update NamedPort %s status: %v", port.Name, uerr)
+		}
+	}
+}
+
+// ListClaims lists the named ports declared by NamedPort resources, in one go
+// (without watching). Used by one-shot commands. Invalid resources are ignored.
+func ListClaims(conf *config.KnpConfig) ([]np.Claim, error) {
+	var claims []np.Claim
+
+	list, err := conf.DynClient.Resource(NamedPortResource).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list NamedPorts: %v", err)
+	}
+
+	for i := range list.Items {
+		claim, err := ObjectClaim(&list.Items[i])
+		if err != nil {
+			conf.Logger.Warningf("Ignoring NamedPort: %v", err)
+			continue
+		}
+
+		claims = append(claims, claim)
+	}
+
+	return claims, nil
+}
+
+// ObjectClaim returns the named port declared by a NamedPort object,
+// validated as the controller does.
+func ObjectClaim(obj *unstructured.Unstructured) (np.Claim, error) {
+	port, err := fromUnstructured(obj)
+	if err != nil {
+		return np.Claim{}, err
+	}
+
+	target, err := validate(port)
+	if err != nil {
+		return np.Claim{}, err
+	}
+
+	return np.Claim{
+		Owner:  "namedport/" + port.Name,
+		Name:   port.Spec.Name,
+		Port:   port.Spec.Port,
+		Target: target,
+	}, nil
+}
+
+// validate checks a NamedPort spec, and returns its port target
+func validate(port *NamedPort) (np.PortTarget, error) {
+	if port.Spec.Name == "" {
+		return np.PortTarget{}, fmt.Errorf("NamedPort %s has no port name", port.Name)
+	}
+
+	if err := np.ValidatePort(port.Spec.Name, port.Spec.Port); err != nil {
+		return np.PortTarget{}, fmt.Errorf("NamedPort %s has an %v", port.Name, err)
+	}
+
+	target, err := np.ParsePortTarget(strings.Join(port.Spec.NodePools, ","), port.Spec.NodePoolSelector)
+	if err != nil {
+		return target, fmt.Errorf("NamedPort %s has an invalid target: %v", port.Name, err)
+	}
+
+	return target, nil
+}
+
+func fromUnstructured(obj interface{}) (*NamedPort, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected object type: %T", obj)
+	}
+
+	port := &NamedPort{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, port); err != nil {
+		return nil, fmt.Errorf("Failed to convert NamedPort %s: %v", u.GetName(), err)
+	}
+
+	return port, nil
+}
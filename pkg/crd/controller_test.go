@@ -0,0 +1,170 @@
+package crd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/worker"
+)
+
+type fakeWorker struct {
+	mu      sync.Mutex
+	ports   np.PortList
+	targets map[string]np.PortTarget
+	owned   map[string][]string
+	handler worker.SyncHandler
+}
+
+func (w *fakeWorker) Start()                   {}
+func (w *fakeWorker) Stop()                    {}
+func (w *fakeWorker) AddMap(ports np.PortList) {}
+func (w *fakeWorker) Trigger()                 {}
+
+func (w *fakeWorker) SetOwnedPorts(owner string, names []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(names) == 0 {
+		delete(w.owned, owner)
+		return
+	}
+	w.owned[owner] = names
+}
+
+func (w *fakeWorker) SetTarget(owner, name string, target np.PortTarget) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.targets[name] = target
+}
+
+func (w *fakeWorker) Add(name string, port int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ports[name] = port
+}
+
+func (w *fakeWorker) OnSync(handler worker.SyncHandler) {
+	w.handler = handler
+}
+
+func newNamedPort(name, portName string, port int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kube-named-ports.io/v1alpha1",
+			"kind":       "NamedPort",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": map[string]interface{}{
+				"name": portName,
+				"port": port,
+			},
+		},
+	}
+}
+
+func TestController(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.DynClient = config.FakeDynClient(
+		newNamedPort("http", "http", 8080),
+		newNamedPort("broken", "broken", 70000),
+	)
+
+	wrk := &fakeWorker{ports: make(np.PortList), targets: make(map[string]np.PortTarget), owned: make(map[string][]string)}
+	c := NewController(conf, wrk)
+	c.startInformer()
+	c.worker.OnSync(c.updateStatus)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		t.Fatal("Timed out waiting for caches to sync")
+	}
+
+	if err := c.processItem("http"); err != nil {
+		t.Errorf("processItem failed on a valid NamedPort: %v", err)
+	}
+	if wrk.ports["http"] != 8080 {
+		t.Errorf("processItem didn't declare the named port: %v", wrk.ports)
+	}
+
+	gpu := newNamedPort("gpu", "gpu", 9090)
+	gpu.Object["spec"].(map[string]interface{})["nodePools"] = []interface{}{"gpu-pool"}
+	if _, err := conf.DynClient.Resource(NamedPortResource).Create(gpu, meta_v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.informer.GetIndexer().Add(gpu); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processItem("gpu"); err != nil {
+		t.Errorf("processItem failed on a targeted NamedPort: %v", err)
+	}
+	if pools := wrk.targets["gpu"].NodePools; len(pools) != 1 || pools[0] != "gpu-pool" {
+		t.Errorf("processItem didn't set the port target: %v", wrk.targets)
+	}
+
+	if err := c.processItem("broken"); err == nil {
+		t.Error("processItem should fail on invalid port values")
+	}
+
+	if err := c.processItem("deleted"); err != nil {
+		t.Errorf("processItem should ignore deleted objects: %v", err)
+	}
+
+	wrk.handler(np.SyncStatus{"http": {"ig-b", "ig-a"}}, nil)
+
+	obj, err := conf.DynClient.Resource(NamedPortResource).Get("http", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get NamedPort: %v", err)
+	}
+
+	igs, _, _ := unstructured.NestedStringSlice(obj.Object, "status", "instanceGroups")
+	if len(igs) != 2 || igs[0] != "ig-a" || igs[1] != "ig-b" {
+		t.Errorf("Unexpected NamedPort status: %v", igs)
+	}
+}
+
+func TestControllerDelete(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.DynClient = config.FakeDynClient(newNamedPort("http", "http", 8080))
+
+	wrk := &fakeWorker{ports: make(np.PortList), targets: make(map[string]np.PortTarget), owned: make(map[string][]string)}
+	c := NewController(conf, wrk)
+	c.startInformer()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		t.Fatal("Timed out waiting for caches to sync")
+	}
+
+	c.processNextItem()
+	if names := wrk.owned["namedport/http"]; len(names) != 1 || names[0] != "http" {
+		t.Fatalf("The NamedPort should own its port: %v", wrk.owned)
+	}
+
+	if err := conf.DynClient.Resource(NamedPortResource).Delete("http", &meta_v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deletion is queued, and processed like other events
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return c.queue.Len() > 0, nil
+	})
+	if err != nil {
+		t.Fatal("The NamedPort deletion wasn't queued")
+	}
+	c.processNextItem()
+	if _, ok := wrk.owned["namedport/http"]; ok {
+		t.Errorf("The deleted NamedPort owner should be forgotten: %v", wrk.owned)
+	}
+}
@@ -0,0 +1,43 @@
+package crd
+
+import (
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// NamedPortResource identifies the NamedPort custom resources
+var NamedPortResource = schema.GroupVersionResource{
+	Group:    "kube-named-ports.io",
+	Version:  "v1alpha1",
+	Resource: "namedports",
+}
+
+// NamedPort declares a named port we want on the cluster's instance groups
+type NamedPort struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NamedPortSpec   `json:"spec"`
+	Status NamedPortStatus `json:"status,omitempty"`
+}
+
+// NamedPortSpec is the expected named port
+type NamedPortSpec struct {
+	// Name is the GCP named port name
+	Name string `json:"name"`
+
+	// Port is the GCP named port value
+	Port int64 `json:"port"`
+
+	// NodePools restricts the named port to those node pools
+	NodePools []string `json:"nodePools,omitempty"`
+
+	// NodePoolSelector restricts the named port to node pools matching this label selector
+	NodePoolSelector string `json:"nodePoolSelector,omitempty"`
+}
+
+// NamedPortStatus reports where the named port is applied
+type NamedPortStatus struct {
+	// InstanceGroups holds the instance groups having this named port
+	InstanceGroups []string `json:"instanceGroups,omitempty"`
+}
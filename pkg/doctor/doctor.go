@@ -0,0 +1,386 @@
+// Package doctor diagnoses the Kubernetes and GCP access kube-named-ports needs.
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"go.opentelemetry.io/otel/attribute"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+	authorization_v1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/crd"
+	"github.com/bpineau/kube-named-ports/pkg/gcpauth"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
+)
+
+// Status is a check outcome
+type Status string
+
+const (
+	// StatusOK means the check passed
+	StatusOK Status = "ok"
+	// StatusWarning means the check found a non fatal issue
+	StatusWarning Status = "warning"
+	// StatusFailed means kube-named-ports won't work as configured
+	StatusFailed Status = "failed"
+	// StatusSkipped means the check couldn't run, or isn't relevant
+	StatusSkipped Status = "skipped"
+)
+
+// Check is a diagnostic result
+type Check struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// rbacRule is an access kube-named-ports needs on the Kubernetes API
+type rbacRule struct {
+	group       string
+	resource    string
+	subresource string
+	verb        string
+}
+
+// those are overridden by tests
+var (
+	onGCE            = metadata.OnGCE
+	metadataProject  = metadata.ProjectID
+	checkCredentials = tokenCheck
+	testPermissions  = projectPermissions
+)
+
+// Run diagnoses a cluster configuration, and returns the checks results
+func Run(conf *config.KnpConfig) []Check {
+	var checks []Check
+
+	ctx := context.Background()
+
+	checks = append(checks, checkKubernetes(conf)...)
+
+	project, check := checkProject(conf)
+	checks = append(checks, check)
+
+	read, write, err := gcpauth.ClientOptions(ctx, conf)
+	if err != nil {
+		return append(checks, Check{
+			Name:   "GCP credentials",
+			Status: StatusFailed,
+			Detail: err.Error(),
+			Hint:   "fix the GCP credentials flags",
+		})
+	}
+
+	readOK := addCheck(&checks, credentialsCheck("GCP credentials", checkCredentials(ctx, read...)))
+
+	writeOK := readOK
+	if conf.WriteServiceAccount != "" {
+		writeOK = addCheck(&checks, credentialsCheck("GCP write identity ("+conf.WriteServiceAccount+")",
+			checkCredentials(ctx, write...)))
+	}
+
+	if project == "" {
+		return checks
+	}
+
+	readPerms, writePerms := requiredPermissions(conf)
+	if readOK {
+		checks = append(checks, permissionsCheck(ctx, "GCP read permissions", project, readPerms, read))
+	}
+	if writeOK {
+		checks = append(checks, permissionsCheck(ctx, "GCP write permissions", project, writePerms, write))
+	}
+
+	return checks
+}
+
+// Failed tells if some checks failed
+func Failed(checks []Check) bool {
+	for _, check := range checks {
+		if check.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func addCheck(checks *[]Check, check Check) bool {
+	*checks = append(*checks, check)
+	return check.Status == StatusOK
+}
+
+// checkKubernetes verifies the Kubernetes API is reachable, and we have the
+// RBAC permissions we need.
+func checkKubernetes(conf *config.KnpConfig) []Check {
+	version, err := conf.ClientSet.Discovery().ServerVersion()
+	if err != nil {
+		return []Check{{
+			Name:   "Kubernetes API access",
+			Status: StatusFailed,
+			Detail: err.Error(),
+			Hint:   "check the api-server, kube-config and kube-context settings",
+		}}
+	}
+
+	checks := []Check{{
+		Name:   "Kubernetes API access",
+		Status: StatusOK,
+		Detail: "server version " + version.GitVersion,
+	}}
+
+	namespaces, err := conf.ClientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		checks = append(checks, Check{
+			Name:   "Kubernetes namespaces listing",
+			Status: StatusFailed,
+			Detail: err.Error(),
+			Hint:   "allow kube-named-ports' service account to list namespaces",
+		})
+	} else {
+		checks = append(checks, Check{
+			Name:   "Kubernetes namespaces listing",
+			Status: StatusOK,
+			Detail: fmt.Sprintf("%d namespaces", len(namespaces.Items)),
+		})
+	}
+
+	var denied []string
+	for _, rule := range requiredRules(conf) {
+		review := &authorization_v1.SelfSubjectAccessReview{
+			Spec: authorization_v1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorization_v1.ResourceAttributes{
+					Group:       rule.group,
+					Resource:    rule.resource,
+					Subresource: rule.subresource,
+					Verb:        rule.verb,
+				},
+			},
+		}
+
+		resp, err := conf.ClientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+		if err != nil {
+			return append(checks, Check{
+				Name:   "Kubernetes RBAC",
+				Status: StatusSkipped,
+				Detail: fmt.Sprintf("failed to review access: %v", err),
+			})
+		}
+
+		if !resp.Status.Allowed {
+			denied = append(denied, rule.String())
+		}
+	}
+
+	if len(denied) > 0 {
+		return append(checks, Check{
+			Name:   "Kubernetes RBAC",
+			Status: StatusFailed,
+			Detail: "denied: " + strings.Join(denied, ", "),
+			Hint:   "grant those verbs to kube-named-ports' service account with a ClusterRole",
+		})
+	}
+
+	return append(checks, Check{Name: "Kubernetes RBAC", Status: StatusOK})
+}
+
+// requiredRules lists the Kubernetes accesses needed by the configured features
+func requiredRules(conf *config.KnpConfig) []rbacRule {
+	rules := []rbacRule{
+		{resource: "services", verb: "list"},
+		{resource: "services", verb: "watch"},
+		{resource: "services", verb: "patch"},
+		{resource: "nodes", verb: "list"},
+		{resource: "nodes", verb: "watch"},
+		{resource: "namespaces", verb: "list"},
+	}
+
+	if conf.AuditSink == "events" {
+		// owners are looked up for their UIDs
+		rules = append(rules,
+			rbacRule{resource: "events", verb: "create"},
+			rbacRule{resource: "services", verb: "get"})
+	}
+
+	if conf.NamedPortCRD {
+		group, resource := crd.NamedPortResource.Group, crd.NamedPortResource.Resource
+		rules = append(rules,
+			rbacRule{group: group, resource: resource, verb: "list"},
+			rbacRule{group: group, resource: resource, verb: "watch"},
+			rbacRule{group: group, resource: resource, subresource: "status", verb: "update"})
+		if conf.AuditSink == "events" {
+			rules = append(rules, rbacRule{group: group, resource: resource, verb: "get"})
+		}
+	}
+
+	return rules
+}
+
+func (r rbacRule) String() string {
+	resource := r.resource
+	if r.group != "" {
+		resource += "." + r.group
+	}
+	if r.subresource != "" {
+		resource += "/" + r.subresource
+	}
+	return r.verb + " " + resource
+}
+
+// checkProject finds the GCP project, from the configuration or the metadata server
+func checkProject(conf *config.KnpConfig) (string, Check) {
+	gce := onGCE()
+	if conf.Project != "" {
+		check := Check{Name: "GCP metadata server", Status: StatusOK}
+		if !gce {
+			check.Status, check.Detail = StatusSkipped, "not running on GCE, and not needed"
+		}
+		if !gce && conf.WorkloadIdentity {
+			check.Status = StatusFailed
+			check.Detail = "unavailable, but needed for workload identity credentials"
+			check.Hint = "run on GKE with Workload Identity enabled, or use other credentials"
+		}
+		return conf.Project, check
+	}
+
+	if !gce {
+		return "", Check{
+			Name:   "GCP metadata server",
+			Status: StatusFailed,
+			Detail: "unavailable, and no project was provided",
+			Hint:   "provide the cluster's project with --project",
+		}
+	}
+
+	project, err := metadataProject()
+	if err != nil {
+		return "", Check{
+			Name:   "GCP metadata server",
+			Status: StatusFailed,
+			Detail: fmt.Sprintf("failed to get project: %v", err),
+			Hint:   "provide the cluster's project with --project",
+		}
+	}
+
+	return project, Check{Name: "GCP metadata server", Status: StatusOK, Detail: "project " + project}
+}
+
+// tokenCheck verifies we can obtain an access token with those options
+func tokenCheck(ctx context.Context, opts ...option.ClientOption) error {
+	creds, err := transport.Creds(ctx, append([]option.ClientOption{option.WithScopes(gcpauth.CloudPlatformScope)}, opts...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = creds.TokenSource.Token()
+	return err
+}
+
+func credentialsCheck(name string, err error) Check {
+	if err != nil {
+		return Check{
+			Name:   name,
+			Status: StatusFailed,
+			Detail: err.Error(),
+			Hint:   "check the credentials, and the roles/iam.serviceAccountTokenCreator grants when impersonating",
+		}
+	}
+	return Check{Name: name, Status: StatusOK}
+}
+
+// methodPermissions gives the IAM permission each GCP API method we call requires.
+// Named ports are set with compute.instanceGroups.setNamedPorts, which requires
+// the compute.instanceGroups.update permission.
+var methodPermissions = map[string]string{
+	"container.projects.zones.clusters.list":               "container.clusters.list",
+	"container.projects.locations.clusters.nodePools.list": "container.clusters.get",
+	"compute.instanceGroupManagers.get":                    "compute.instanceGroupManagers.get",
+	"compute.instances.get":                                "compute.instances.get",
+	"compute.instanceGroups.get":                           "compute.instanceGroups.get",
+	"compute.instanceGroups.aggregatedList":                "compute.instanceGroups.list",
+	"compute.instanceGroups.setNamedPorts":                 "compute.instanceGroups.update",
+}
+
+// requiredPermissions lists the GCP permissions needed by the configured features
+func requiredPermissions(conf *config.KnpConfig) (read, write []string) {
+	readMethods, writeMethods := np.APIMethods(conf)
+	return permissionsFor(readMethods), permissionsFor(writeMethods)
+}
+
+func permissionsFor(methods []string) []string {
+	var perms []string
+	seen := make(map[string]bool)
+	for _, method := range methods {
+		perm := methodPermissions[method]
+		if !seen[perm] {
+			seen[perm] = true
+			perms = append(perms, perm)
+		}
+	}
+
+	sort.Strings(perms)
+	return perms
+}
+
+// projectPermissions returns the permissions, among the provided ones, granted on a project
+func projectPermissions(ctx context.Context, project string, permissions []string, opts ...option.ClientOption) ([]string, error) {
+	svc, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize resource manager client: %v", err)
+	}
+
+	req := &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}
+	ctx, span := tracing.StartClient(ctx, "cloudresourcemanager.projects.testIamPermissions",
+		attribute.String("project", project))
+	resp, err := svc.Projects.TestIamPermissions(project, req).Context(ctx).Do()
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Permissions, nil
+}
+
+func permissionsCheck(ctx context.Context, name, project string, wanted []string, opts []option.ClientOption) Check {
+	granted, err := testPermissions(ctx, project, wanted, opts...)
+	if err != nil {
+		return Check{
+			Name:   name,
+			Status: StatusSkipped,
+			Detail: fmt.Sprintf("failed to test permissions on project %s: %v", project, err),
+			Hint:   "enable the Cloud Resource Manager API to allow permissions checks",
+		}
+	}
+
+	has := make(map[string]bool)
+	for _, perm := range granted {
+		has[perm] = true
+	}
+
+	var missing []string
+	for _, perm := range wanted {
+		if !has[perm] {
+			missing = append(missing, perm)
+		}
+	}
+
+	if len(missing) > 0 {
+		return Check{
+			Name:   name,
+			Status: StatusFailed,
+			Detail: fmt.Sprintf("missing on project %s: %s", project, strings.Join(missing, ", ")),
+			Hint:   "grant a role with those permissions (ie. roles/compute.instanceAdmin.v1, roles/container.clusterViewer)",
+		}
+	}
+
+	return Check{Name: name, Status: StatusOK, Detail: "on project " + project}
+}
@@ -0,0 +1,152 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+	authorization_v1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+func fakeGCP(gce bool, granted ...string) {
+	onGCE = func() bool { return gce }
+	metadataProject = func() (string, error) { return "meta-project", nil }
+	checkCredentials = func(ctx context.Context, opts ...option.ClientOption) error { return nil }
+	testPermissions = func(ctx context.Context, project string, perms []string, opts ...option.ClientOption) ([]string, error) {
+		return granted, nil
+	}
+}
+
+func findCheck(t *testing.T, checks []Check, name string) Check {
+	for _, check := range checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("Check %q not found in %v", name, checks)
+	return Check{}
+}
+
+func TestRun(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.Cluster = "foo"
+	conf.NamedPortCRD = true
+
+	conf.ClientSet.(*fake.Clientset).PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorization_v1.SelfSubjectAccessReview)
+			attrs := review.Spec.ResourceAttributes
+			review.Status.Allowed = attrs.Verb != "patch" && attrs.Subresource != "status"
+			return true, review, nil
+		})
+
+	fakeGCP(true, "compute.instanceGroupManagers.get", "container.clusters.get", "container.clusters.list")
+
+	checks := Run(conf)
+	if !Failed(checks) {
+		t.Errorf("Checks should fail: %v", checks)
+	}
+
+	rbac := findCheck(t, checks, "Kubernetes RBAC")
+	if rbac.Status != StatusFailed ||
+		rbac.Detail != "denied: patch services, update namedports.kube-named-ports.io/status" {
+		t.Errorf("Unexpected RBAC check: %+v", rbac)
+	}
+
+	if check := findCheck(t, checks, "Kubernetes namespaces listing"); check.Status != StatusOK {
+		t.Errorf("Unexpected namespaces listing check: %+v", check)
+	}
+
+	if check := findCheck(t, checks, "GCP metadata server"); check.Detail != "project meta-project" {
+		t.Errorf("Unexpected metadata check: %+v", check)
+	}
+
+	if check := findCheck(t, checks, "GCP read permissions"); check.Status != StatusOK {
+		t.Errorf("Unexpected read permissions check: %+v", check)
+	}
+
+	write := findCheck(t, checks, "GCP write permissions")
+	if write.Status != StatusFailed || !strings.Contains(write.Detail, "compute.instanceGroups.update") {
+		t.Errorf("Unexpected write permissions check: %+v", write)
+	}
+}
+
+func TestRunWithoutGCE(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.ClientSet.(*fake.Clientset).PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, &authorization_v1.SelfSubjectAccessReview{}, fmt.Errorf("forbidden")
+		})
+	conf.ClientSet.(*fake.Clientset).PrependReactor("list", "namespaces",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("forbidden")
+		})
+
+	fakeGCP(false)
+
+	checks := Run(conf)
+	if check := findCheck(t, checks, "GCP metadata server"); check.Status != StatusFailed {
+		t.Errorf("Metadata check should fail without a project: %+v", check)
+	}
+	if check := findCheck(t, checks, "Kubernetes namespaces listing"); check.Status != StatusFailed {
+		t.Errorf("Namespaces listing check should fail: %+v", check)
+	}
+	if check := findCheck(t, checks, "Kubernetes RBAC"); check.Status != StatusSkipped {
+		t.Errorf("RBAC check should be skipped on review errors: %+v", check)
+	}
+	for _, check := range checks {
+		if strings.HasSuffix(check.Name, "permissions") {
+			t.Errorf("Permissions can't be checked without a project: %+v", check)
+		}
+	}
+}
+
+func TestRequiredPermissions(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.Discovery = "nodes"
+	conf.UnmanagedGroups = "^legacy-"
+
+	read, write := requiredPermissions(conf)
+	expected := "compute.instanceGroups.get,compute.instanceGroups.list,compute.instances.get"
+	if strings.Join(read, ",") != expected {
+		t.Errorf("Unexpected read permissions: %v", read)
+	}
+	if len(write) != 1 || write[0] != "compute.instanceGroups.update" {
+		t.Errorf("Unexpected write permissions: %v", write)
+	}
+
+	conf = config.FakeConfig()
+	conf.Discovery = "gke"
+
+	read, _ = requiredPermissions(conf)
+	expected = "compute.instanceGroupManagers.get,container.clusters.get,container.clusters.list"
+	if strings.Join(read, ",") != expected {
+		t.Errorf("Unexpected read permissions without a zone: %v", read)
+	}
+}
+
+// TestMethodPermissions ensures each GCP method the discovery calls (as
+// verified by namedports' TestAPIMethods) has a known required permission.
+func TestMethodPermissions(t *testing.T) {
+	for _, discovery := range []string{"gke", "nodes"} {
+		for _, zone := range []string{"", "europe-west1-b"} {
+			conf := config.FakeConfig()
+			conf.Discovery, conf.Zone, conf.UnmanagedGroups = discovery, zone, "^legacy-"
+
+			read, write := np.APIMethods(conf)
+			for _, method := range append(read, write...) {
+				if methodPermissions[method] == "" {
+					t.Errorf("No permission known for %s, called with %s discovery", method, discovery)
+				}
+			}
+		}
+	}
+}
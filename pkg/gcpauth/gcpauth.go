@@ -0,0 +1,136 @@
+// Package gcpauth builds the credentials used to talk to GCP APIs.
+package gcpauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
+)
+
+// CloudPlatformScope is the OAuth2 scope we request for impersonated tokens
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// ClientOptions returns the GCP clients options for read and for write
+// (named ports updates) operations, according to the configuration.
+//
+// Credentials are chained: the base identity comes from the credentials file,
+// or from the metadata server when using Workload Identity, or else from the
+// default credentials. It may impersonate a service account (possibly through
+// delegates) to obtain the read identity, which may in turn impersonate the
+// write service account, used for updates only.
+func ClientOptions(ctx context.Context, conf *config.KnpConfig) ([]option.ClientOption, []option.ClientOption, error) {
+	var read []option.ClientOption
+
+	if conf.CredentialsFile != "" && conf.WorkloadIdentity {
+		return nil, nil, fmt.Errorf("credentials file and workload identity are mutually exclusive")
+	}
+
+	if conf.CredentialsFile != "" {
+		read = append(read, option.WithCredentialsFile(conf.CredentialsFile))
+	}
+
+	if conf.WorkloadIdentity {
+		ts := google.ComputeTokenSource("", CloudPlatformScope)
+		read = append(read, option.WithTokenSource(ts))
+	}
+
+	if conf.ImpersonateServiceAccount != "" {
+		ts := impersonatedTokens(ctx, conf.GCPTimeout, conf.ImpersonateServiceAccount, conf.ImpersonateDelegates, read...)
+		read = []option.ClientOption{option.WithTokenSource(ts)}
+	} else if len(conf.ImpersonateDelegates) > 0 {
+		return nil, nil, fmt.Errorf("impersonation delegates require a service account to impersonate")
+	}
+
+	write := read
+	if conf.WriteServiceAccount != "" {
+		ts := impersonatedTokens(ctx, conf.GCPTimeout, conf.WriteServiceAccount, nil, read...)
+		write = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+
+	return read, write, nil
+}
+
+// impersonatedTokenSource mints short lived access tokens for a target service
+// account, through the IAM credentials API, authenticated as the base identity.
+type impersonatedTokenSource struct {
+	ctx       context.Context
+	timeout   time.Duration
+	base      []option.ClientOption
+	target    string
+	delegates []string
+}
+
+// impersonatedTokens returns a token source impersonating the target
+// service account. The base options provide the identity used to call the
+// IAM credentials API (default credentials when empty). The target must grant
+// roles/iam.serviceAccountTokenCreator to the base identity, or, when delegates
+// are provided, to the last delegate (each delegate granting that role to the
+// next one in the chain, starting with the base identity). Token requests are
+// bounded by timeout (when not 0).
+func impersonatedTokens(ctx context.Context, timeout time.Duration, target string, delegates []string, base ...option.ClientOption) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		ctx:       ctx,
+		timeout:   timeout,
+		base:      base,
+		target:    target,
+		delegates: delegates,
+	})
+}
+
+// Token implements oauth2.TokenSource
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	svc, err := iamcredentials.NewService(ts.ctx, ts.base...)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize iam credentials client: %v", err)
+	}
+
+	var delegates []string
+	for _, d := range ts.delegates {
+		delegates = append(delegates, serviceAccountName(d))
+	}
+
+	req := &iamcredentials.GenerateAccessTokenRequest{
+		Delegates: delegates,
+		Scope:     []string{CloudPlatformScope},
+	}
+
+	ctx := ts.ctx
+	if ts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ts.timeout)
+		defer cancel()
+	}
+
+	ctx, span := tracing.StartClient(ctx, "iamcredentials.serviceAccounts.generateAccessToken",
+		attribute.String("service_account", ts.target))
+	resp, err := svc.Projects.ServiceAccounts.GenerateAccessToken(serviceAccountName(ts.target), req).Context(ctx).Do()
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %v", ts.target, err)
+	}
+
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid impersonated token expiration %q: %v", resp.ExpireTime, err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// serviceAccountName returns the IAM resource name of a service account email
+func serviceAccountName(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
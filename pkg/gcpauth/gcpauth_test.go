@@ -0,0 +1,42 @@
+package gcpauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bpineau/kube-named-ports/config"
+)
+
+func TestClientOptions(t *testing.T) {
+	ctx := context.Background()
+
+	read, write, err := ClientOptions(ctx, &config.KnpConfig{})
+	if err != nil || len(read) != 0 || len(write) != 0 {
+		t.Errorf("Default credentials shouldn't need options: %v %v %v", read, write, err)
+	}
+
+	read, write, err = ClientOptions(ctx, &config.KnpConfig{
+		CredentialsFile:           "/dev/null",
+		ImpersonateServiceAccount: "reader@project.iam.gserviceaccount.com",
+		WriteServiceAccount:       "writer@project.iam.gserviceaccount.com",
+	})
+	if err != nil || len(read) != 1 || len(write) != 1 || read[0] == write[0] {
+		t.Errorf("Expected distinct read and write identities: %v %v %v", read, write, err)
+	}
+
+	_, _, err = ClientOptions(ctx, &config.KnpConfig{CredentialsFile: "/dev/null", WorkloadIdentity: true})
+	if err == nil {
+		t.Error("ClientOptions should reject both credentials file and workload identity")
+	}
+
+	_, _, err = ClientOptions(ctx, &config.KnpConfig{ImpersonateDelegates: []string{"foo@bar"}})
+	if err == nil {
+		t.Error("ClientOptions should reject delegates without impersonated service account")
+	}
+}
+
+func TestServiceAccountName(t *testing.T) {
+	if serviceAccountName("foo@bar") != "projects/-/serviceAccounts/foo@bar" {
+		t.Errorf("Unexpected service account resource name: %s", serviceAccountName("foo@bar"))
+	}
+}
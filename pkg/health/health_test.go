@@ -42,7 +42,11 @@ func TestHealthCheckHandler(t *testing.T) {
 		t.Errorf("HeartBeatService should fail with a wrong port")
 	}
 
-	hh.conf.Logger = log.New("warning", "", "test")
+	logger, err := log.New("warning", "", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hh.conf.Logger = logger
 	hh.healthCheckReply(new(FailingResponseWriter), &http.Request{RemoteAddr: "127.0.0.1"})
 	hook := hh.conf.Logger.Hooks[logrus.InfoLevel][0].(*test.Hook)
 	if len(hook.Entries) != 1 {
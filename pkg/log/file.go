@@ -0,0 +1,89 @@
+package log
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	filePrefix = "file:"
+
+	// default maximum log file size, in megabytes
+	defaultMaxSize = 100
+)
+
+// newFileOutput returns a rotating file writer, from a "file:<path>" output
+// with optional rotation settings as query parameters, ie.
+// file:/var/log/knp.log?max-size=100&max-age=7&max-backups=5&compress=true
+//
+// The file is reopened on SIGHUP, so it can be rotated by external tools too.
+func newFileOutput(logOutput string) (*lumberjack.Logger, error) {
+	u, err := url.Parse(logOutput)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log file output %q: %v", logOutput, err)
+	}
+
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("log file output needs a path (ie. file:/var/log/kube-named-ports.log)")
+	}
+
+	output := &lumberjack.Logger{
+		Filename: path,
+		MaxSize:  defaultMaxSize,
+	}
+
+	for key, values := range u.Query() {
+		value := values[0]
+		switch key {
+		case "max-size":
+			output.MaxSize, err = strconv.Atoi(value)
+		case "max-age":
+			output.MaxAge, err = strconv.Atoi(value)
+		case "max-backups":
+			output.MaxBackups, err = strconv.Atoi(value)
+		case "compress":
+			output.Compress, err = strconv.ParseBool(value)
+		case "local-time":
+			output.LocalTime, err = strconv.ParseBool(value)
+		default:
+			return nil, fmt.Errorf("unknown log file option %q", key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid log file option %s=%q: %v", key, value, err)
+		}
+	}
+
+	// fail early when the file can't be written
+	if _, err = output.Write(nil); err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	reopenOnSignal(output, syscall.SIGHUP)
+
+	return output, nil
+}
+
+// reopenOnSignal closes the log file when receiving the signal: the
+// next write will reopen (or create) the file at the configured path.
+func reopenOnSignal(output *lumberjack.Logger, sig os.Signal) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, sig)
+
+	go func() {
+		for range sigs {
+			// errors would surface on the next write
+			_ = output.Close()
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "knp.log")
+	logger := mustNew(t, "info", "", "file:"+path+"?max-size=1&max-backups=2&compress=true", "json")
+
+	output, ok := logger.Out.(*lumberjack.Logger)
+	if !ok {
+		t.Fatalf("Unexpected file output: %T", logger.Out)
+	}
+	if output.MaxSize != 1 || output.MaxBackups != 2 || !output.Compress || output.MaxAge != 0 {
+		t.Errorf("Unexpected rotation settings: %+v", output)
+	}
+
+	logger.Info("Changed: foo")
+	content, err := ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(content), "Changed: foo") {
+		t.Fatalf("Log entry not found in log file (%v): %s", err, content)
+	}
+
+	// the file is reopened on SIGHUP, ie. after an external rotation
+	if err = os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		logger.Info("Changed: bar")
+		if _, err = os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	content, err = ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(content), "Changed: bar") {
+		t.Errorf("Log file wasn't reopened on SIGHUP (%v): %s", err, content)
+	}
+}
+
+func TestFileOutputErrors(t *testing.T) {
+	notDir, err := ioutil.TempFile("", "knp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notDir.Close()
+	defer os.Remove(notDir.Name())
+
+	for _, output := range []string{
+		"file:",
+		"file:/tmp/knp.log?max-size=big",
+		"file:/tmp/knp.log?rotate=true",
+		"file:" + filepath.Join(notDir.Name(), "knp.log"),
+	} {
+		if _, err := New("info", "", output, ""); err == nil {
+			t.Errorf("file logger should fail with %q output", output)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gcpSeverities maps logrus levels to Cloud Logging severities
+var gcpSeverities = map[logrus.Level]string{
+	logrus.TraceLevel: "DEBUG",
+	logrus.DebugLevel: "DEBUG",
+	logrus.InfoLevel:  "INFO",
+	logrus.WarnLevel:  "WARNING",
+	logrus.ErrorLevel: "ERROR",
+	logrus.FatalLevel: "CRITICAL",
+	logrus.PanicLevel: "ALERT",
+}
+
+// gcpFormatter formats entries as json, following the Cloud Logging structured
+// logging conventions (https://cloud.google.com/logging/docs/structured-logging).
+type gcpFormatter struct{}
+
+// Format implements logrus.Formatter
+func (f *gcpFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+3)
+	for k, v := range entry.Data {
+		// errors don't serialize to json by themselves
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		data[k] = v
+	}
+
+	data["severity"] = gcpSeverities[entry.Level]
+	data["message"] = entry.Message
+	data["timestamp"] = entry.Time.Format(time.RFC3339Nano)
+
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields to json: %v", err)
+	}
+
+	return append(serialized, '\n'), nil
+}
@@ -2,29 +2,39 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-
-	"log/syslog"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
-	ls "github.com/sirupsen/logrus/hooks/syslog"
 	"github.com/sirupsen/logrus/hooks/test"
 )
 
-// New initialize logrus and return a new logger.
-func New(logLevel string, logServer string, logOutput string) *logrus.Logger {
-	level, err := logrus.ParseLevel(logLevel)
-	if err != nil {
-		level = logrus.InfoLevel
+// New initialize logrus and return a new logger. The log level defaults to info,
+// and the log format may be text (default), json, or gcp (json following Cloud
+// Logging conventions). Unknown levels, formats or outputs are errors.
+// The syslog server may be given as "host:port" (udp), or as an udp://,
+// tcp:// or tls:// url.
+func New(logLevel string, logServer string, logOutput string, logFormat string) (*logrus.Logger, error) {
+	level := logrus.InfoLevel
+	if logLevel != "" {
+		var err error
+		if level, err = logrus.ParseLevel(logLevel); err != nil {
+			return nil, fmt.Errorf("invalid log level: %v", err)
+		}
 	}
 
-	output, hook := getOutput(logServer, logOutput)
+	formatter, err := getFormatter(logFormat)
+	if err != nil {
+		return nil, err
+	}
 
-	formatter := &logrus.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: "2006-01-02 15:04:05",
+	output, hook, err := getOutput(logServer, logOutput)
+	if err != nil {
+		return nil, err
 	}
 
 	log := &logrus.Logger{
@@ -38,14 +48,38 @@ func New(logLevel string, logServer string, logOutput string) *logrus.Logger {
 		log.Hooks.Add(hook)
 	}
 
-	return log
+	return log, nil
 }
 
-func getOutput(logServer string, logOutput string) (io.Writer, logrus.Hook) {
+func getFormatter(logFormat string) (logrus.Formatter, error) {
+	switch logFormat {
+	case "json":
+		return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	case "gcp":
+		return &gcpFormatter{}, nil
+	case "text", "":
+		return &logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02 15:04:05",
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q (should be text, json or gcp)", logFormat)
+}
+
+func getOutput(logServer string, logOutput string) (io.Writer, logrus.Hook, error) {
 	var output io.Writer
 	var hook logrus.Hook
 	var err error
 
+	if strings.HasPrefix(logOutput, filePrefix) {
+		file, err := newFileOutput(logOutput)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, nil, nil
+	}
+
 	switch logOutput {
 	case "stdout":
 		output = os.Stdout
@@ -56,16 +90,15 @@ func getOutput(logServer string, logOutput string) (io.Writer, logrus.Hook) {
 		_, hook = test.NewNullLogger()
 	case "syslog":
 		output = os.Stderr // does not matter ?
-		if logServer == "" {
-			panic("syslog output needs a log server (ie. 127.0.0.1:514)")
-		}
-		hook, err = ls.NewSyslogHook("udp", logServer, syslog.LOG_INFO, "kube-named-ports")
+		hook, err = newSyslogHook(logServer)
 		if err != nil {
-			panic(err)
+			return nil, nil, err
 		}
-	default:
+	case "":
 		output = os.Stderr
+	default:
+		return nil, nil, fmt.Errorf("unknown log output %q (should be stderr, stdout, syslog or file:<path>)", logOutput)
 	}
 
-	return output, hook
+	return output, hook, nil
 }
@@ -1,9 +1,11 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
@@ -20,10 +22,18 @@ var (
 	}
 )
 
+func mustNew(t *testing.T, logLevel string, logServer string, logOutput string, logFormat string) *logrus.Logger {
+	logger, err := New(logLevel, logServer, logOutput, logFormat)
+	if err != nil {
+		t.Fatalf("Failed to instantiate a logger: %v", err)
+	}
+	return logger
+}
+
 func TestLog(t *testing.T) {
 	const logrusLogger = "*logrus.Logger"
 
-	logger := New("warning", "", "test")
+	logger := mustNew(t, "warning", "", "test", "")
 
 	logger.Info("Changed: foo")
 	logger.Warn("Changed: bar")
@@ -39,55 +49,104 @@ func TestLog(t *testing.T) {
 		t.Errorf("Unexpected log entry: %s", hook.LastEntry().Message)
 	}
 
-	logger = New("", "", "test")
+	logger = mustNew(t, "", "", "test", "")
 	if logger.Level != logrus.InfoLevel {
 		t.Error("The default loglevel should be info")
 	}
 
-	logger = New("", "", "")
+	logger = mustNew(t, "", "", "", "")
 	if logger.Out != os.Stderr {
 		t.Error("The default output should be stderr")
 	}
 
-	logger = New("info", "127.0.0.1:514", "syslog")
+	logger = mustNew(t, "info", "127.0.0.1:514", "syslog", "")
 	if fmt.Sprintf("%T", logger) != logrusLogger {
 		t.Error("Failed to instantiate a syslog logger")
 	}
 
-	logger = New("info", "", "stdout")
+	logger = mustNew(t, "info", "", "stdout", "")
 	if fmt.Sprintf("%T", logger) != logrusLogger {
 		t.Error("Failed to instantiate a stdout logger")
 	}
 
-	logger = New("info", "", "stderr")
+	logger = mustNew(t, "info", "", "stderr", "")
 	if fmt.Sprintf("%T", logger) != logrusLogger {
 		t.Error("Failed to instantiate a stderr logger")
 	}
 
 	for _, level := range levels {
-		lg := New(level, "", "test")
+		lg := mustNew(t, level, "", "test", "")
 		if fmt.Sprintf("%T", lg) != logrusLogger {
 			t.Errorf("Failed to instantiate at %s level", level)
 		}
 	}
 }
 
-func TestSyslogMissingArg(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("syslog logger should panic without a server")
+func TestSyslogWrongArgs(t *testing.T) {
+	for _, server := range []string{
+		"",
+		"wrong server",
+		"http://127.0.0.1:514",
+		"tls://127.0.0.1:6514?ca=/does/not/exist",
+		"tcp://127.0.0.1:1",
+	} {
+		if _, err := New("info", server, "syslog", ""); err == nil {
+			t.Errorf("syslog logger should fail with %q server", server)
 		}
-	}()
+	}
+}
+
+func TestFormats(t *testing.T) {
+	entry := &logrus.Entry{
+		Level:   logrus.WarnLevel,
+		Message: "Changed: foo",
+		Data:    logrus.Fields{"service": "default/foo", "error": fmt.Errorf("boom")},
+		Time:    time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC),
+	}
+
+	formatter, err := getFormatter("gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := formatter.Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_ = New("info", "", "syslog")
+	var fields map[string]string
+	if err = json.Unmarshal(out, &fields); err != nil {
+		t.Fatalf("gcp format isn't json: %v (%s)", err, out)
+	}
+	if fields["severity"] != "WARNING" || fields["message"] != "Changed: foo" ||
+		fields["timestamp"] != "2019-11-20T10:00:00Z" || fields["service"] != "default/foo" ||
+		fields["error"] != "boom" {
+		t.Errorf("Unexpected gcp formatted entry: %s", out)
+	}
+
+	if formatter, _ = getFormatter("json"); formatter == nil {
+		t.Fatal("json format should be supported")
+	}
+	if _, ok := formatter.(*logrus.JSONFormatter); !ok {
+		t.Error("json format should use a json formatter")
+	}
+
+	if formatter, _ = getFormatter(""); formatter == nil {
+		t.Fatal("The default format should be supported")
+	}
+	if _, ok := formatter.(*logrus.TextFormatter); !ok {
+		t.Error("The default format should be text")
+	}
 }
 
-func TestSyslogWrongArg(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("syslog logger should panic on wrong server address")
+func TestWrongSettings(t *testing.T) {
+	for _, args := range [][]string{
+		{"levle", "", "test", ""},
+		{"info", "", "stdrr", ""},
+		{"info", "", "test", "xml"},
+	} {
+		if _, err := New(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("New%q should fail", args)
 		}
-	}()
-
-	_ = New("info", "wrong server", "syslog")
+	}
 }
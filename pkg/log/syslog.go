@@ -0,0 +1,218 @@
+package log
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	syslogAppName = "kube-named-ports"
+
+	// daemon facility, as in log/syslog's LOG_DAEMON
+	syslogFacility = 3 << 3
+
+	// RFC5424 timestamps allow up to microseconds
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// syslogWriteTimeout bounds each write, so an unresponsive log server can't
+// block the logging callers (overridden by tests)
+var syslogWriteTimeout = 5 * time.Second
+
+// syslogReconnectDelay is how long entries are dropped, without trying to
+// reconnect, after a failure to reach the log server
+var syslogReconnectDelay = 10 * time.Second
+
+// syslogSeverities maps logrus levels to syslog severities
+var syslogSeverities = map[logrus.Level]int{
+	logrus.PanicLevel: 2, // crit
+	logrus.FatalLevel: 2, // crit
+	logrus.ErrorLevel: 3, // err
+	logrus.WarnLevel:  4, // warning
+	logrus.InfoLevel:  6, // info
+	logrus.DebugLevel: 7, // debug
+	logrus.TraceLevel: 7, // debug
+}
+
+// syslogHook sends RFC5424 formatted entries to a syslog server, over udp,
+// tcp or tls. Stream transports use octet counting framing (RFC6587).
+type syslogHook struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	hostname  string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	retryAt time.Time
+}
+
+// newSyslogHook parses a syslog server address, which may be a plain "host:port"
+// (udp), or an udp://, tcp:// or tls:// url. The tls CA can be provided with
+// a "ca" query parameter (ie. tls://logs.example.com:6514?ca=/etc/ssl/ca.pem),
+// the system CAs are used otherwise.
+func newSyslogHook(server string) (*syslogHook, error) {
+	if server == "" {
+		return nil, fmt.Errorf("syslog output needs a log server (ie. 127.0.0.1:514)")
+	}
+
+	hook := &syslogHook{network: "udp", addr: server}
+
+	if strings.Contains(server, "://") {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log server %q: %v", server, err)
+		}
+
+		hook.network, hook.addr = u.Scheme, u.Host
+
+		if hook.network == "tls" {
+			hook.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+			if ca := u.Query().Get("ca"); ca != "" {
+				pool, err := loadCA(ca)
+				if err != nil {
+					return nil, err
+				}
+				hook.tlsConfig.RootCAs = pool
+			}
+		}
+	}
+
+	if hook.network != "udp" && hook.network != "tcp" && hook.network != "tls" {
+		return nil, fmt.Errorf("unsupported log server protocol %q (should be udp, tcp or tls)", hook.network)
+	}
+
+	if _, _, err := net.SplitHostPort(hook.addr); err != nil {
+		return nil, fmt.Errorf("invalid log server address %q: %v", hook.addr, err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	hook.hostname = hostname
+
+	if err = hook.connect(); err != nil {
+		return nil, err
+	}
+
+	return hook, nil
+}
+
+func loadCA(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log server CA: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificate found in log server CA %s", file)
+	}
+
+	return pool, nil
+}
+
+// connect (re)connects to the syslog server. Must be called with mu held,
+// or before the hook is shared.
+func (h *syslogHook) connect() error {
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if h.network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", h.addr, h.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(h.network, h.addr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to connect to log server %s: %v", h.addr, err)
+	}
+
+	h.conn = conn
+	return nil
+}
+
+// Levels implements logrus.Hook
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+
+	msg := h.format(entry, strings.TrimRight(line, "\n"))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// retry once on a fresh connection, ie. after a server restart
+	if h.conn != nil {
+		if err = h.write(msg); err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+	} else if time.Now().Before(h.retryAt) {
+		// the server was just found unreachable: drop the entry
+		return nil
+	}
+
+	if err = h.connect(); err == nil {
+		if err = h.write(msg); err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+	}
+
+	h.retryAt = time.Now().Add(syslogReconnectDelay)
+	return err
+}
+
+// write sends a message on the current connection, within syslogWriteTimeout.
+// Must be called with mu held.
+func (h *syslogHook) write(msg []byte) error {
+	if err := h.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout)); err != nil {
+		return err
+	}
+
+	_, err := h.conn.Write(msg)
+	return err
+}
+
+// format returns an RFC5424 message, framed for the transport
+func (h *syslogHook) format(entry *logrus.Entry, line string) []byte {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		syslogFacility+syslogSeverities[entry.Level],
+		entry.Time.Format(syslogTimeFormat),
+		h.hostname, syslogAppName, os.Getpid(), line)
+
+	if h.network == "udp" {
+		return []byte(msg)
+	}
+
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
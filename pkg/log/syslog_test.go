@@ -0,0 +1,239 @@
+package log
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ kube-named-ports \d+ - - (.*)$`)
+
+// readFrame reads an octet counted syslog message
+func readFrame(t *testing.T, conn net.Conn) string {
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	size, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("Failed to read syslog frame: %v", err)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		t.Fatalf("Invalid syslog frame size %q", size)
+	}
+
+	buf := make([]byte, n)
+	if _, err = r.Read(buf); err != nil {
+		t.Fatalf("Failed to read syslog message: %v", err)
+	}
+
+	return string(buf)
+}
+
+func checkSyslog(t *testing.T, ln net.Listener, server string) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// tls clients wait for the handshake to complete
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			_ = tlsConn.Handshake()
+		}
+		accepted <- conn
+	}()
+
+	logger := mustNew(t, "info", server, "syslog", "json")
+	logger.Out = ioutil.Discard
+	logger.Warn("Changed: foo")
+
+	conn := <-accepted
+	defer conn.Close()
+
+	msg := readFrame(t, conn)
+	match := rfc5424.FindStringSubmatch(msg)
+	if match == nil {
+		t.Fatalf("Not an RFC5424 message: %q", msg)
+	}
+	if match[1] != "28" || !strings.Contains(match[2], `"msg":"Changed: foo"`) {
+		t.Errorf("Unexpected syslog message: %q", msg)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	checkSyslog(t, ln, "tcp://"+ln.Addr().String())
+}
+
+func TestSyslogUnresponsiveServer(t *testing.T) {
+	defer func(timeout time.Duration) { syslogWriteTimeout = timeout }(syslogWriteTimeout)
+	syslogWriteTimeout = 50 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server accepts connections, but never reads from them
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	hook, err := newSyslogHook("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// once the socket buffers are full, writes time out instead of blocking
+	msg := []byte(strings.Repeat("x", 1<<16))
+	for i := 0; i < 10000 && err == nil; i++ {
+		err = hook.write(msg)
+	}
+
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Writes to an unresponsive server should time out, got: %v", err)
+	}
+
+	// a stuck connection is replaced, and the retry is bounded too
+	logger := mustNew(t, "info", "", "stdout", "text")
+	logger.Out = ioutil.Discard
+
+	start := time.Now()
+	_ = hook.Fire(logger.WithField("foo", "bar"))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Logging to an unresponsive server took too long: %v", elapsed)
+	}
+}
+
+func TestSyslogReconnectDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook, err := newSyslogHook("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := mustNew(t, "info", "", "stdout", "text")
+	logger.Out = ioutil.Discard
+
+	// the server goes away: the entry is lost, and reconnections are delayed
+	ln.Close()
+	hook.conn.Close()
+	if err = hook.Fire(logger.WithField("foo", "bar")); err == nil {
+		t.Fatal("Fire should fail when the server is unreachable")
+	}
+	if hook.retryAt.IsZero() {
+		t.Fatal("A reconnection delay should be set")
+	}
+
+	if err = hook.Fire(logger.WithField("foo", "bar")); err != nil || hook.conn != nil {
+		t.Errorf("Entries should be dropped without reconnecting during the delay: %v", err)
+	}
+
+	// once the delay expired, the hook reconnects
+	ln, err = net.Listen("tcp", hook.addr)
+	if err != nil {
+		t.Skipf("Failed to listen again on %s: %v", hook.addr, err)
+	}
+	defer ln.Close()
+
+	hook.retryAt = time.Now()
+	if err = hook.Fire(logger.WithField("foo", "bar")); err != nil || hook.conn == nil {
+		t.Errorf("The hook should reconnect after the delay: %v", err)
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "knp-syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	if err = ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	checkSyslog(t, ln, "tls://"+ln.Addr().String()+"?ca="+ca)
+
+	// without our CA, the server certificate can't be verified
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	if _, err = New("info", "tls://"+ln.Addr().String(), "syslog", ""); err == nil {
+		t.Error("syslog logger should fail to verify the server certificate")
+	}
+}
@@ -0,0 +1,155 @@
+package namedports
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
+)
+
+var (
+	// retryBaseDelay and retryMaxDelay bound the retries exponential backoff
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 32 * time.Second
+
+	// limiters holds the GCP calls token buckets, shared by clusters in the same project
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*rate.Limiter)
+
+	// apiMetrics counts the GCP calls and their throttling, exposed by expvar
+	// (ie. on the healthcheck port, at /debug/vars)
+	apiMetrics = expvar.NewMap("gcp_api")
+)
+
+// projectLimiter returns the token bucket shared by all the GCP calls made for
+// a project. The first caller's settings prevail.
+func projectLimiter(project string, limit float64, burst int) *rate.Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	if _, ok := limiters[project]; !ok {
+		limiters[project] = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+
+	return limiters[project]
+}
+
+// call runs a GCP API call, traced, paced by the project's token bucket, and
+// bounded by the configured timeout. Rate limited (429 and rateLimitExceeded)
+// and server side (5xx) failures are retried with a jittered exponential backoff.
+func (n *NamedPort) call(ctx context.Context, name string, attrs []attribute.KeyValue, fn func(context.Context) error) error {
+	ctx, span := tracing.StartClient(ctx, name, attrs...)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = n.attempt(ctx, fn)
+
+		throttled, retryable := classify(err)
+		if throttled {
+			apiMetrics.Add("rate_limited", 1)
+		}
+		if !retryable || attempt >= n.retries {
+			break
+		}
+
+		delay := backoff(attempt, err)
+		apiMetrics.Add("retries", 1)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt+1),
+			attribute.String("delay", delay.String())))
+		n.logger.WithFields(logrus.Fields{"call": name, "attempt": attempt + 1, "rate_limited": throttled}).
+			Warningf("GCP call %s failed (will retry in %v): %v", name, delay, err)
+
+		select {
+		case <-ctx.Done():
+			tracing.End(span, err)
+			return err
+		case <-time.After(delay):
+		}
+	}
+
+	if err != nil {
+		apiMetrics.Add("errors", 1)
+	}
+	tracing.End(span, err)
+
+	return err
+}
+
+// attempt runs a single GCP API call, once the token bucket allows it
+func (n *NamedPort) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if n.limiter != nil {
+		start := time.Now()
+		if err := n.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if wait := time.Since(start); wait > time.Millisecond {
+			apiMetrics.Add("limiter_waits", 1)
+			apiMetrics.Add("limiter_wait_ms", int64(wait/time.Millisecond))
+			n.logger.Debugf("GCP call delayed %v by the client side rate limit", wait)
+		}
+	}
+
+	if n.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.timeout)
+		defer cancel()
+	}
+
+	apiMetrics.Add("calls", 1)
+	return fn(ctx)
+}
+
+// classify tells if an error is a rate limiting response, and if it is worth retrying
+func classify(err error) (throttled bool, retryable bool) {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false, false
+	}
+
+	switch {
+	case gerr.Code == http.StatusTooManyRequests:
+		return true, true
+	case gerr.Code >= 500:
+		return false, true
+	case gerr.Code == http.StatusForbidden:
+		// compute reports exceeded rate quotas as 403
+		for _, item := range gerr.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true, true
+			}
+		}
+	}
+
+	return false, false
+}
+
+// backoff returns the delay before a retry: a random duration (full jitter) up to
+// an exponentially growing bound, or the server's Retry-After when it's longer.
+func backoff(attempt int, err error) time.Duration {
+	bound := retryMaxDelay
+	if attempt < 16 && retryBaseDelay<<uint(attempt) < retryMaxDelay {
+		bound = retryBaseDelay << uint(attempt)
+	}
+	delay := time.Duration(rand.Int63n(int64(bound))) + 1
+
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Header != nil {
+		if secs, perr := strconv.Atoi(gerr.Header.Get("Retry-After")); perr == nil {
+			if after := time.Duration(secs) * time.Second; after > delay {
+				delay = after
+			}
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,110 @@
+package namedports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/bpineau/kube-named-ports/config"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err       error
+		throttled bool
+		retryable bool
+	}{
+		{nil, false, false},
+		{fmt.Errorf("boom"), false, false},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true, true},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, false, true},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true, true},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, false, false},
+		{&googleapi.Error{Code: http.StatusNotFound}, false, false},
+	}
+
+	for _, tt := range tests {
+		throttled, retryable := classify(tt.err)
+		if throttled != tt.throttled || retryable != tt.retryable {
+			t.Errorf("classify(%v) = %v, %v; want %v, %v", tt.err, throttled, retryable, tt.throttled, tt.retryable)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 70; attempt++ {
+		delay := backoff(attempt, nil)
+		if delay <= 0 || delay > retryMaxDelay {
+			t.Errorf("backoff(%d) = %v, should be in ]0, %v]", attempt, delay, retryMaxDelay)
+		}
+	}
+
+	if delay := backoff(0, nil); delay > retryBaseDelay {
+		t.Errorf("first retry should wait at most %v, got %v", retryBaseDelay, delay)
+	}
+
+	err := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"40"}}}
+	if delay := backoff(0, err); delay != 40*time.Second {
+		t.Errorf("backoff should honor Retry-After, got %v", delay)
+	}
+}
+
+func TestCallRetries(t *testing.T) {
+	defer func(base time.Duration) { retryBaseDelay = base }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	n := &NamedPort{retries: 3, logger: config.FakeConfig().Logger}
+
+	calls := 0
+	err := n.call(context.Background(), "flaky", nil, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("rate limited calls should be retried, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = n.call(context.Background(), "broken", nil, func(ctx context.Context) error {
+		calls++
+		return &googleapi.Error{Code: http.StatusInternalServerError}
+	})
+	if err == nil || calls != 4 {
+		t.Errorf("retries should stop after max retries, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = n.call(context.Background(), "notfound", nil, func(ctx context.Context) error {
+		calls++
+		return &googleapi.Error{Code: http.StatusNotFound}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("client errors shouldn't be retried, got %d calls", calls)
+	}
+}
+
+func TestCallRateLimit(t *testing.T) {
+	n := &NamedPort{limiter: projectLimiter("test-rate-limit", 100, 1), logger: config.FakeConfig().Logger}
+	if projectLimiter("test-rate-limit", 1, 1) != n.limiter {
+		t.Error("a project's calls should share the same token bucket")
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := n.call(context.Background(), "paced", nil, func(ctx context.Context) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 100 calls/s and no burst: the 4 calls after the first wait 10ms each
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("calls should be paced by the rate limit, 5 calls took %v", elapsed)
+	}
+}
@@ -0,0 +1,110 @@
+package namedports
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// GCP named ports names must comply with RFC1035
+var portNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Claim is a named port declared by a Kubernetes object
+type Claim struct {
+	// Owner identifies the declaring object, ie. "service/<namespace>/<name>"
+	Owner string `json:"owner"`
+
+	// Name is the named port name
+	Name string `json:"name"`
+
+	// Port is the named port value
+	Port int64 `json:"port"`
+
+	// Target restricts the named port to some node pools
+	Target PortTarget `json:"target,omitempty"`
+}
+
+// FromClaims returns the expected ports and their targets from a claims list.
+// A later claim overrides a previous one's value for the same port. Targets are
+// the union of the claims': a port is expected on all node pools as soon as one
+// of its claims doesn't restrict it.
+func FromClaims(claims []Claim) (PortList, TargetList) {
+	ports := make(PortList)
+	targets := make(TargetList)
+	untargeted := make(map[string]bool)
+
+	for _, claim := range claims {
+		ports[claim.Name] = claim.Port
+		if claim.Target.IsZero() {
+			untargeted[claim.Name] = true
+			delete(targets, claim.Name)
+		} else if !untargeted[claim.Name] {
+			targets[claim.Name] = append(targets[claim.Name], claim.Target)
+		}
+	}
+
+	return ports, targets
+}
+
+// OwnerList holds, by port name, the objects declaring the port
+type OwnerList map[string][]string
+
+// Owners returns the objects declaring each port, from a claims list
+func Owners(claims []Claim) OwnerList {
+	owners := make(OwnerList)
+	for _, claim := range claims {
+		owners[claim.Name] = append(owners[claim.Name], claim.Owner)
+	}
+	return owners
+}
+
+// of returns the sorted, deduplicated owners of the provided ports
+func (o OwnerList) of(names []string) []string {
+	seen := make(map[string]bool)
+	var owners []string
+	for _, name := range names {
+		for _, owner := range o[name] {
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// ValidatePort checks a named port name and value are acceptable for GCP
+func ValidatePort(name string, port int64) error {
+	if !portNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid port name %q (should match %s)", name, portNameRegexp)
+	}
+
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port value for %q: %d", name, port)
+	}
+
+	return nil
+}
+
+// Conflicts returns, by port name, the claims declaring a same named
+// port with distinct values.
+func Conflicts(claims []Claim) map[string][]Claim {
+	byName := make(map[string][]Claim)
+	for _, claim := range claims {
+		byName[claim.Name] = append(byName[claim.Name], claim)
+	}
+
+	conflicts := make(map[string][]Claim)
+	for name, named := range byName {
+		for _, claim := range named[1:] {
+			if claim.Port != named[0].Port {
+				sort.Slice(named, func(i, j int) bool { return named[i].Owner < named[j].Owner })
+				conflicts[name] = named
+				break
+			}
+		}
+	}
+
+	return conflicts
+}
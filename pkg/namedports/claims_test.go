@@ -0,0 +1,56 @@
+package namedports
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePort(t *testing.T) {
+	for _, name := range []string{"http", "a", "port-8080"} {
+		if err := ValidatePort(name, 8080); err != nil {
+			t.Errorf("ValidatePort(%q) failed: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", "Http", "8080", "port-", "with_underscore"} {
+		if err := ValidatePort(name, 8080); err == nil {
+			t.Errorf("ValidatePort(%q) should fail", name)
+		}
+	}
+
+	for _, port := range []int64{0, -1, 65536} {
+		if err := ValidatePort("http", port); err == nil {
+			t.Errorf("ValidatePort should fail on port %d", port)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	conflicts := Conflicts([]Claim{
+		{Owner: "service/default/b", Name: "http", Port: 8081},
+		{Owner: "service/default/a", Name: "http", Port: 8080},
+		{Owner: "service/default/c", Name: "https", Port: 8443},
+		{Owner: "namedport/https", Name: "https", Port: 8443},
+	})
+
+	if len(conflicts) != 1 || len(conflicts["http"]) != 2 {
+		t.Fatalf("Unexpected conflicts: %v", conflicts)
+	}
+	if conflicts["http"][0].Owner != "service/default/a" {
+		t.Errorf("Conflicting claims should be sorted by owner: %v", conflicts["http"])
+	}
+}
+
+func TestOwners(t *testing.T) {
+	owners := Owners([]Claim{
+		{Owner: "service/default/b", Name: "http", Port: 8080},
+		{Owner: "service/default/a", Name: "http", Port: 8080},
+		{Owner: "service/default/a", Name: "https", Port: 8443},
+		{Owner: "namedport/metrics", Name: "metrics", Port: 9100},
+	})
+
+	got := owners.of([]string{"http", "https", "unknown"})
+	if strings.Join(got, ",") != "service/default/a,service/default/b" {
+		t.Errorf("Unexpected owners: %v", got)
+	}
+}
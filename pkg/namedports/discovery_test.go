@@ -0,0 +1,162 @@
+package namedports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/bpineau/kube-named-ports/config"
+)
+
+// fakeGCP serves minimal compute and container APIs, and records the methods called
+type fakeGCP struct {
+	sync.Mutex
+	methods map[string]bool
+}
+
+var fakeGCPResponses = []struct {
+	method   string
+	path     *regexp.Regexp
+	response string
+}{
+	{"container.projects.zones.clusters.list", regexp.MustCompile(`/zones/-/clusters$`),
+		`{"clusters": [{"name": "foo", "zone": "europe-west1-b"}]}`},
+	{"container.projects.locations.clusters.nodePools.list", regexp.MustCompile(`/clusters/foo/nodePools$`),
+		`{"nodePools": [{"name": "default-pool", "instanceGroupUrls": [
+		"https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instanceGroupManagers/gke-foo-default-pool-grp"]}]}`},
+	{"compute.instanceGroupManagers.get", regexp.MustCompile(`/instanceGroupManagers/[^/]+$`), `{}`},
+	{"compute.instances.get", regexp.MustCompile(`/instances/[^/]+$`),
+		`{"metadata": {"items": [{"key": "created-by",
+		"value": "projects/123/zones/europe-west1-b/instanceGroupManagers/gke-foo-default-pool-grp"}]}}`},
+	{"compute.instanceGroups.setNamedPorts", regexp.MustCompile(`/instanceGroups/[^/]+/setNamedPorts$`), `{}`},
+	{"compute.instanceGroups.get", regexp.MustCompile(`/zones/[^/]+/instanceGroups/[^/]+$`), `{}`},
+	{"compute.instanceGroups.aggregatedList", regexp.MustCompile(`/aggregated/instanceGroups$`),
+		`{"items": {"zones/europe-west1-b": {"instanceGroups": [{"name": "legacy-grp",
+		"zone": "https://www.googleapis.com/compute/beta/projects/my-project/zones/europe-west1-b"}]}}}`},
+}
+
+func (f *fakeGCP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, resp := range fakeGCPResponses {
+		if resp.path.MatchString(r.URL.Path) {
+			f.Lock()
+			f.methods[resp.method] = true
+			f.Unlock()
+			fmt.Fprint(w, resp.response)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func TestAPIMethods(t *testing.T) {
+	node := &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "gke-foo-default-pool-grp-x1"},
+		Spec:       core_v1.NodeSpec{ProviderID: "gce://my-project/europe-west1-b/gke-foo-default-pool-grp-x1"},
+	}
+
+	confs := []*config.KnpConfig{
+		{Discovery: DiscoveryGKE},
+		{Discovery: DiscoveryGKE, Zone: "europe-west1-b", UnmanagedGroups: "^legacy-"},
+		{Discovery: DiscoveryNodes},
+		{Discovery: DiscoveryNodes, UnmanagedGroups: "^legacy-"},
+	}
+
+	for _, conf := range confs {
+		gcp := &fakeGCP{methods: make(map[string]bool)}
+		srv := httptest.NewServer(gcp)
+
+		opts := []option.ClientOption{option.WithEndpoint(srv.URL + "/"), option.WithoutAuthentication()}
+		n := &NamedPort{
+			zone:      conf.Zone,
+			project:   "my-project",
+			cluster:   "foo",
+			discovery: conf.Discovery,
+			clientset: fake.NewSimpleClientset(node),
+			instances: make(map[string]igRef),
+			readOpts:  opts,
+			writeOpts: opts,
+			logger:    config.FakeConfig().Logger,
+			dryrun:    func() bool { return false },
+		}
+		if conf.UnmanagedGroups != "" {
+			n.unmanaged = regexp.MustCompile(conf.UnmanagedGroups)
+		}
+
+		ctx := context.Background()
+		if n.zone == "" && n.discovery == DiscoveryGKE {
+			svc, _, err := getServices(ctx, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.zone, err = n.getClusterZone(ctx, svc); err != nil || n.zone != "europe-west1-b" {
+				t.Fatalf("Failed to get the cluster zone: %q, %v", n.zone, err)
+			}
+		}
+
+		if _, err := n.ResyncNamedPorts(ctx, PortList{"http": 8080}, nil, nil); err != nil {
+			t.Fatalf("Resync failed with %s discovery: %v", conf.Discovery, err)
+		}
+		srv.Close()
+
+		var called []string
+		for method := range gcp.methods {
+			called = append(called, method)
+		}
+
+		read, write := APIMethods(conf)
+		expected := append(read, write...)
+
+		sort.Strings(called)
+		sort.Strings(expected)
+		if strings.Join(called, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s discovery (zone %q, unmanaged %q) called %v, but APIMethods lists %v",
+				conf.Discovery, conf.Zone, conf.UnmanagedGroups, called, expected)
+		}
+	}
+}
+
+func TestInstancesCachePruned(t *testing.T) {
+	node := &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "gke-foo-default-pool-grp-x1"},
+		Spec:       core_v1.NodeSpec{ProviderID: "gce://my-project/europe-west1-b/gke-foo-default-pool-grp-x1"},
+	}
+
+	srv := httptest.NewServer(&fakeGCP{methods: make(map[string]bool)})
+	defer srv.Close()
+
+	opts := []option.ClientOption{option.WithEndpoint(srv.URL + "/"), option.WithoutAuthentication()}
+	_, csvc, err := getServices(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &NamedPort{
+		project:   "my-project",
+		clientset: fake.NewSimpleClientset(node),
+		instances: map[string]igRef{"my-project/europe-west1-b/gke-foo-default-pool-grp-gone": {name: "gke-foo-default-pool-grp"}},
+		logger:    config.FakeConfig().Logger,
+	}
+
+	igz, err := n.getNodesInstanceGroups(context.Background(), csvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*igz) != 1 || (*igz)[0].name != "gke-foo-default-pool-grp" {
+		t.Errorf("Unexpected instance groups: %+v", *igz)
+	}
+
+	if _, ok := n.instances["my-project/europe-west1-b/gke-foo-default-pool-grp-x1"]; !ok || len(n.instances) != 1 {
+		t.Errorf("Only the current nodes instances should be cached: %v", n.instances)
+	}
+}
@@ -0,0 +1,71 @@
+package namedports
+
+import (
+	"context"
+	"sort"
+)
+
+// PortInfo is an instance group's named port, with the claims declaring it
+type PortInfo struct {
+	Name string `json:"name"`
+	Port int64  `json:"port"`
+
+	// Owners lists the claims owners declaring this named port
+	Owners []string `json:"owners,omitempty"`
+
+	// Foreign is true when the named port isn't declared by any claim
+	Foreign bool `json:"foreign"`
+}
+
+// InstanceGroupInfo describes an instance group and its current named ports
+type InstanceGroupInfo struct {
+	Project  string     `json:"project"`
+	Zone     string     `json:"zone"`
+	Name     string     `json:"name"`
+	NodePool string     `json:"nodePool,omitempty"`
+	Ports    []PortInfo `json:"ports"`
+}
+
+// Inventory lists the cluster's instance groups and their current named ports,
+// annotated with the claims declaring them.
+func (n *NamedPort) Inventory(ctx context.Context, claims []Claim) ([]InstanceGroupInfo, error) {
+	var infos []InstanceGroupInfo
+
+	igz, err := n.discover(ctx)
+	if err != nil {
+		return infos, err
+	}
+
+	for _, ig := range *igz {
+		infos = append(infos, inventory(&ig, claims))
+	}
+
+	return infos, nil
+}
+
+// inventory annotates an instance group's named ports with their claims owners
+func inventory(ig *igInfo, claims []Claim) InstanceGroupInfo {
+	info := InstanceGroupInfo{
+		Project:  ig.project,
+		Zone:     ig.zone,
+		Name:     ig.name,
+		NodePool: ig.nodePool,
+		Ports:    []PortInfo{},
+	}
+
+	for name, port := range ig.ports {
+		pi := PortInfo{Name: name, Port: port}
+		for _, claim := range claims {
+			if claim.Name == name && claim.Port == port && claim.Target.Matches(ig.nodePool, ig.labels) {
+				pi.Owners = append(pi.Owners, claim.Owner)
+			}
+		}
+		sort.Strings(pi.Owners)
+		pi.Foreign = len(pi.Owners) == 0
+		info.Ports = append(info.Ports, pi)
+	}
+
+	sort.Slice(info.Ports, func(i, j int) bool { return info.Ports[i].Name < info.Ports[j].Name })
+
+	return info
+}
@@ -0,0 +1,35 @@
+package namedports
+
+import (
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	ig := &igInfo{
+		name:     "gke-foo-gpu-pool-1234abcd-grp",
+		nodePool: "gpu-pool",
+		ports:    PortList{"http": 8080, "gpu": 9090, "legacy": 1234},
+	}
+
+	info := inventory(ig, []Claim{
+		{Owner: "service/default/web", Name: "http", Port: 8080},
+		{Owner: "service/default/api", Name: "http", Port: 8080},
+		{Owner: "namedport/gpu", Name: "gpu", Port: 9090, Target: PortTarget{NodePools: []string{"gpu-pool"}}},
+		{Owner: "service/default/old", Name: "legacy", Port: 4321},
+	})
+
+	if len(info.Ports) != 3 {
+		t.Fatalf("Unexpected ports: %+v", info.Ports)
+	}
+
+	gpu, http, legacy := info.Ports[0], info.Ports[1], info.Ports[2]
+	if gpu.Foreign || len(gpu.Owners) != 1 || gpu.Owners[0] != "namedport/gpu" {
+		t.Errorf("Unexpected gpu port info: %+v", gpu)
+	}
+	if http.Foreign || len(http.Owners) != 2 || http.Owners[0] != "service/default/api" {
+		t.Errorf("Unexpected http port info: %+v", http)
+	}
+	if !legacy.Foreign {
+		t.Errorf("Ports claimed with another value should be foreign: %+v", legacy)
+	}
+}
@@ -1,84 +1,200 @@
 package namedports
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"regexp"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 	compute "google.golang.org/api/compute/v0.beta"
 	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/option"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/audit"
+	"github.com/bpineau/kube-named-ports/pkg/gcpauth"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
+)
+
+const (
+	// DiscoveryGKE finds instance groups through the GKE node pools API
+	DiscoveryGKE = "gke"
+
+	// DiscoveryNodes finds instance groups from the Kubernetes nodes objects
+	DiscoveryNodes = "nodes"
 )
 
 // PortList is a group of named ports (port name, port number)
 type PortList map[string]int64
 
+// SyncStatus lists, by port name, the instance groups having the expected named port
+type SyncStatus map[string][]string
+
 // NamedPort maintains instance groups named ports in sync with a provided PortList
 type NamedPort struct {
-	zone    string
-	cluster string
-	project string
-	context context.Context
-	logger  *logrus.Logger
-	dryrun  bool
+	zone      string
+	cluster   string
+	project   string
+	discovery string
+	clientset kubernetes.Interface
+	instances map[string]igRef
+	planned   map[string]PortList
+	unmanaged *regexp.Regexp
+	readOpts  []option.ClientOption
+	writeOpts []option.ClientOption
+	timeout   time.Duration
+	retries   int
+	limiter   *rate.Limiter
+	logger    *logrus.Logger
+	auditor   audit.Sink
+	dryrun    func() bool
 }
 
 type igInfo struct {
-	name  string
-	zone  string
-	ports PortList
+	name     string
+	zone     string
+	project  string
+	nodePool string
+	labels   map[string]string
+	ports    PortList
+}
+
+// attributes returns the tracing attributes identifying an instance group
+func (ig *igInfo) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("instance_group", ig.name),
+		attribute.String("zone", ig.zone),
+		attribute.String("project", ig.project),
+	}
+}
+
+// key identifies an instance group
+func (ig *igInfo) key() string {
+	return ig.project + "/" + ig.zone + "/" + ig.name
 }
 
-// NewNamedPort returns a NamedPort instance
-func NewNamedPort(zone, cluster, project string, dryrun bool, logger *logrus.Logger) *NamedPort {
+// logFields returns the structured logging fields identifying an instance group
+func (ig *igInfo) logFields() logrus.Fields {
+	return logrus.Fields{
+		"instance_group": ig.name,
+		"zone":           ig.zone,
+		"project":        ig.project,
+		"node_pool":      ig.nodePool,
+	}
+}
+
+// NewNamedPort returns a NamedPort instance. The context is used to guess
+// the cluster's zone, and bounds the impersonated credentials lifetime.
+func NewNamedPort(ctx context.Context, conf *config.KnpConfig) (*NamedPort, error) {
 	var err error
-	ctx := context.Background()
+	cluster, project := conf.Cluster, conf.Project
+
+	discovery := conf.Discovery
+	if discovery == "" {
+		discovery = DiscoveryGKE
+	}
 
-	if cluster == "" {
-		log.Fatal("Cluster name is mandatory")
+	if discovery != DiscoveryGKE && discovery != DiscoveryNodes {
+		return nil, fmt.Errorf("unknown instance groups discovery mode: %q", discovery)
+	}
+
+	if cluster == "" && discovery == DiscoveryGKE {
+		return nil, fmt.Errorf("cluster name is mandatory")
 	}
 
 	if project == "" {
 		project, err = metadata.ProjectID()
 		if err != nil {
-			log.Fatalf("Could not find current GCP project: %v", err)
+			return nil, fmt.Errorf("could not find current GCP project: %v", err)
 		}
 	}
 
-	if zone == "" {
-		svc, _, err := getServices(ctx)
+	readOpts, writeOpts, err := gcpauth.ClientOptions(ctx, conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GCP credentials options: %v", err)
+	}
+
+	var unmanaged *regexp.Regexp
+	if conf.UnmanagedGroups != "" {
+		unmanaged, err = regexp.Compile(conf.UnmanagedGroups)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unmanaged instance groups pattern: %v", err)
+		}
+	}
+
+	n := &NamedPort{
+		zone:      conf.Zone,
+		project:   project,
+		cluster:   cluster,
+		discovery: discovery,
+		clientset: conf.ClientSet,
+		instances: make(map[string]igRef),
+		planned:   make(map[string]PortList),
+		unmanaged: unmanaged,
+		readOpts:  readOpts,
+		writeOpts: writeOpts,
+		timeout:   conf.GCPTimeout,
+		retries:   conf.GCPMaxRetries,
+		dryrun:    conf.IsDryRun,
+		logger:    conf.Logger,
+		auditor:   conf.Auditor,
+	}
+
+	if conf.GCPRateLimit > 0 {
+		n.limiter = projectLimiter(project, conf.GCPRateLimit, conf.GCPBurst)
+	}
+
+	if n.zone == "" && discovery == DiscoveryGKE {
+		svc, _, err := getServices(ctx, readOpts...)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
-		zone, err = getClusterZone(project, cluster, svc)
+		n.zone, err = n.getClusterZone(ctx, svc)
 		if err != nil {
-			log.Fatalf("Could not find cluster zone: %v", err)
+			return nil, fmt.Errorf("could not find cluster zone: %v", err)
 		}
 	}
 
-	return &NamedPort{
-		zone:    zone,
-		project: project,
-		cluster: cluster,
-		context: ctx,
-		dryrun:  dryrun,
-		logger:  logger,
+	return n, nil
+}
+
+// APIMethods lists the GCP API methods called, with the read and write credentials,
+// to discover and update a configuration's instance groups.
+func APIMethods(conf *config.KnpConfig) (read, write []string) {
+	if conf.Discovery == DiscoveryNodes {
+		read = append(read, "compute.instances.get", "compute.instanceGroups.get")
+	} else {
+		if conf.Zone == "" {
+			read = append(read, "container.projects.zones.clusters.list")
+		}
+		read = append(read, "container.projects.locations.clusters.nodePools.list",
+			"compute.instanceGroupManagers.get")
+	}
+
+	if conf.UnmanagedGroups != "" {
+		read = append(read, "compute.instanceGroups.aggregatedList")
 	}
+
+	return read, []string{"compute.instanceGroups.setNamedPorts"}
 }
 
-func getServices(ctx context.Context) (*container.Service, *compute.Service, error) {
-	// We'll use the current host ServiceAccount if possible. If not available,
-	// pass auth according to https://cloud.google.com/docs/authentication/
+func getServices(ctx context.Context, opts ...option.ClientOption) (*container.Service, *compute.Service, error) {
+	// Without explicit credentials options, we'll use the current host ServiceAccount
+	// if possible. If not available, pass auth according to https://cloud.google.com/docs/authentication/
 	// (ie. via GOOGLE_APPLICATION_CREDENTIALS environment or otherwise).
-	svc, err := container.NewService(ctx)
+	svc, err := container.NewService(ctx, opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not initialize gke client: %v", err)
 	}
 
-	csvc, err := compute.NewService(ctx)
+	csvc, err := compute.NewService(ctx, opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not initialize compute client: %v", err)
 	}
@@ -87,59 +203,117 @@ func getServices(ctx context.Context) (*container.Service, *compute.Service, err
 }
 
 // ResyncNamedPorts ensure the GKE cluster's instance groups have the
-// named ports described by the provided PortList.
-func (n *NamedPort) ResyncNamedPorts(expected PortList) error {
-	svc, csvc, err := getServices(n.context)
+// named ports described by the provided PortList, restricted to the
+// node pools they target when listed in the provided TargetList.
+// The returned SyncStatus reports the instance groups where each expected
+// port is set, even when an error interrupted the resync.
+//
+// The owners, declaring each port, are reported in the changes audit records.
+func (n *NamedPort) ResyncNamedPorts(ctx context.Context, expected PortList, targets TargetList, owners OwnerList) (status SyncStatus, err error) {
+	ctx, span := tracing.Start(ctx, "namedports.ResyncNamedPorts", attribute.String("cluster", n.cluster))
+	defer func() { tracing.End(span, err) }()
+
+	status = make(SyncStatus)
+
+	// the dry-run mode may change on configuration reloads, but holds for a whole resync
+	dryrun := n.dryrun()
+
+	igz, err := n.discover(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to init GCP service: %v", err)
+		return status, err
 	}
 
-	igz, err := n.getInstanceGroups(svc, csvc)
+	wsvc, err := compute.NewService(ctx, n.writeOpts...)
 	if err != nil {
-		return fmt.Errorf("could not find cluster's instancegroups: %v", err)
+		return status, fmt.Errorf("could not initialize compute writer client: %v", err)
 	}
 
 	for _, ig := range *igz {
-		dirty := false
-		for ename, eport := range expected {
-			if igport, ok := ig.ports[ename]; ok {
-				if eport == igport {
-					continue
-				}
+		var missing []string
+		wanted := targets.filter(expected, &ig)
+		for _, change := range diff(wanted, &ig) {
+			n.logger.WithFields(ig.logFields()).WithField("port_name", change.Name).
+				Infof("Need to %s %s->%d port on InstanceGroup %s", change.Action, change.Name, change.After, ig.name)
+			missing = append(missing, change.Name)
+		}
+
+		for ename, eport := range wanted {
+			if igport, ok := ig.ports[ename]; ok && igport == eport {
+				status[ename] = append(status[ename], ig.name)
 			}
-			n.logger.Infof("Need to add %s->%d port on InstanceGroup %s", ename, eport, ig.name)
-			dirty = true
 		}
 
-		if !dirty {
+		if len(missing) == 0 {
+			delete(n.planned, ig.key())
 			continue
 		}
 
-		if n.dryrun {
-			fmt.Printf("Instance group %s needs a named ports update (dry-run)", ig.name)
+		// don't start new writes once cancelled (ie. on shutdown)
+		if err = ctx.Err(); err != nil {
+			return status, fmt.Errorf("resync interrupted: %v", err)
+		}
+
+		err := n.updateNamedPorts(ctx, wanted, &ig, wsvc, owners.of(missing), dryrun)
+		if err != nil {
+			return status, fmt.Errorf("failed to update instance group: %v", err)
+		}
+
+		if dryrun {
 			continue
 		}
 
-		err := n.updateNamedPorts(expected, &ig, csvc)
+		for _, name := range missing {
+			status[name] = append(status[name], ig.name)
+		}
+	}
+
+	return status, nil
+}
+
+// discover returns the cluster's instance groups, and their current named ports
+func (n *NamedPort) discover(ctx context.Context) (*[]igInfo, error) {
+	svc, csvc, err := getServices(ctx, n.readOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init GCP service: %v", err)
+	}
+
+	var igz *[]igInfo
+	if n.discovery == DiscoveryNodes {
+		igz, err = n.getNodesInstanceGroups(ctx, csvc)
+	} else {
+		igz, err = n.getInstanceGroups(ctx, svc, csvc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not find cluster's instancegroups: %v", err)
+	}
+
+	if n.unmanaged != nil {
+		extra, err := n.getUnmanagedInstanceGroups(ctx, csvc)
 		if err != nil {
-			return fmt.Errorf("failed to update instance group: %v", err)
+			return nil, err
 		}
+		mergeInstanceGroups(igz, extra)
 	}
 
-	return nil
+	return igz, nil
 }
 
-func getClusterZone(project string, cluster string, svc *container.Service) (string, error) {
+func (n *NamedPort) getClusterZone(ctx context.Context, svc *container.Service) (string, error) {
 	var zone string
 
-	list, err := svc.Projects.Zones.Clusters.List(project, "-").Do() // "-" == all zones
+	var list *container.ListClustersResponse
+	err := n.call(ctx, "container.projects.zones.clusters.list", []attribute.KeyValue{attribute.String("project", n.project)},
+		func(ctx context.Context) (err error) {
+			list, err = svc.Projects.Zones.Clusters.List(n.project, "-").Context(ctx).Do() // "-" == all zones
+			return err
+		})
 
 	if err != nil {
 		return zone, fmt.Errorf("failed to list clusters: %v", err)
 	}
 
 	for _, v := range list.Clusters {
-		if v.Name == cluster {
+		if v.Name == n.cluster {
 			zone = v.Zone
 			break
 		}
@@ -148,26 +322,48 @@ func getClusterZone(project string, cluster string, svc *container.Service) (str
 	return zone, nil
 }
 
-func (n *NamedPort) getInstanceGroups(svc *container.Service, csvc *compute.Service) (*[]igInfo, error) {
+func (n *NamedPort) getInstanceGroups(ctx context.Context, svc *container.Service, csvc *compute.Service) (igs *[]igInfo, err error) {
 	var igz []igInfo
 
+	ctx, span := tracing.Start(ctx, "namedports.listNodePools", attribute.String("cluster", n.cluster))
+	defer func() { tracing.End(span, err) }()
+
 	parent := "projects/" + n.project + "/locations/" + n.zone + "/clusters/" + n.cluster
-	poolList, err := svc.Projects.Locations.Clusters.NodePools.List(parent).Do()
+	var poolList *container.ListNodePoolsResponse
+	err = n.call(ctx, "container.projects.locations.clusters.nodePools.list", []attribute.KeyValue{attribute.String("cluster", n.cluster)},
+		func(ctx context.Context) (err error) {
+			poolList, err = svc.Projects.Locations.Clusters.NodePools.List(parent).Context(ctx).Do()
+			return err
+		})
 	if err != nil {
 		return &igz, fmt.Errorf("failed to list node pools for cluster %q: %v", n.cluster, err)
 	}
 
 	for _, np := range poolList.NodePools {
+		var poolLabels map[string]string
+		if np.Config != nil {
+			poolLabels = np.Config.Labels
+		}
+
 		for _, ig := range np.InstanceGroupUrls {
+			// https://www.googleapis.com/compute/v1/projects/<project>/zones/<zone>/instanceGroupManagers/<name>
+			// the instance groups project differs from the cluster's with shared VPCs
 			elm := strings.Split(ig, "/")
 
 			igroup := igInfo{
-				name:  elm[10],
-				zone:  elm[8],
-				ports: make(PortList),
+				name:     elm[10],
+				zone:     elm[8],
+				project:  elm[6],
+				nodePool: np.Name,
+				labels:   poolLabels,
+				ports:    make(PortList),
 			}
 
-			req, err := csvc.InstanceGroupManagers.Get(n.project, igroup.zone, igroup.name).Do()
+			var req *compute.InstanceGroupManager
+			err = n.call(ctx, "compute.instanceGroupManagers.get", igroup.attributes(), func(ctx context.Context) (err error) {
+				req, err = csvc.InstanceGroupManagers.Get(igroup.project, igroup.zone, igroup.name).Context(ctx).Do()
+				return err
+			})
 			if err != nil {
 				return &igz, fmt.Errorf("failed to collect named ports: %v", err)
 			}
@@ -182,7 +378,10 @@ func (n *NamedPort) getInstanceGroups(svc *container.Service, csvc *compute.Serv
 	return &igz, nil
 }
 
-func (n *NamedPort) updateNamedPorts(ports PortList, ig *igInfo, csvc *compute.Service) error {
+// updateNamedPorts sets the instance group named ports (unless in dry-run mode),
+// and emits an audit record of the change. In dry-run mode, a planned change is
+// only recorded when it differs from the last one recorded for the instance group.
+func (n *NamedPort) updateNamedPorts(ctx context.Context, ports PortList, ig *igInfo, csvc *compute.Service, owners []string, dryrun bool) error {
 	var namedPorts []*compute.NamedPort
 	mergedPorts := make(PortList)
 
@@ -199,10 +398,66 @@ func (n *NamedPort) updateNamedPorts(ports PortList, ig *igInfo, csvc *compute.S
 
 	}
 
-	n.logger.Infof("Will update namedports for %s instancegroup\n", ig.name)
+	record := &audit.Record{
+		Time:          time.Now().UTC(),
+		Cluster:       n.cluster,
+		Project:       ig.project,
+		Zone:          ig.zone,
+		InstanceGroup: ig.name,
+		Before:        ig.ports,
+		After:         mergedPorts,
+		Owners:        owners,
+		DryRun:        dryrun,
+	}
 
-	rb := &compute.InstanceGroupsSetNamedPortsRequest{NamedPorts: namedPorts}
-	_, err := csvc.InstanceGroups.SetNamedPorts(n.project, ig.zone, ig.name, rb).Do()
+	var err error
+	if dryrun {
+		if samePorts(n.planned[ig.key()], mergedPorts) {
+			n.logger.WithFields(ig.logFields()).Debugf("Instance group %s still needs a named ports update (dry-run)", ig.name)
+			return nil
+		}
+		n.planned[ig.key()] = mergedPorts
+		n.logger.WithFields(ig.logFields()).Infof("Instance group %s needs a named ports update (dry-run)", ig.name)
+	} else {
+		delete(n.planned, ig.key())
+
+		n.logger.WithFields(ig.logFields()).Infof("Will update namedports for %s instancegroup", ig.name)
+
+		rb := &compute.InstanceGroupsSetNamedPortsRequest{NamedPorts: namedPorts}
+		err = n.call(ctx, "compute.instanceGroups.setNamedPorts", ig.attributes(), func(ctx context.Context) error {
+			_, err := csvc.InstanceGroups.SetNamedPorts(ig.project, ig.zone, ig.name, rb).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			record.Error = err.Error()
+		}
+	}
+
+	n.audit(record)
 
 	return err
 }
+
+// samePorts tells if two port lists are identical
+func samePorts(a, b PortList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, port := range a {
+		if bport, ok := b[name]; !ok || bport != port {
+			return false
+		}
+	}
+	return true
+}
+
+// audit emits an audit record, when auditing is enabled
+func (n *NamedPort) audit(record *audit.Record) {
+	if n.auditor == nil {
+		return
+	}
+
+	if err := n.auditor.Record(record); err != nil {
+		n.logger.WithField("instance_group", record.InstanceGroup).Errorf("Failed to record audit: %v", err)
+	}
+}
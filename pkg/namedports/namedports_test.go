@@ -0,0 +1,91 @@
+package namedports
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/audit"
+)
+
+type fakeAuditor struct {
+	records []*audit.Record
+}
+
+func (a *fakeAuditor) Record(rec *audit.Record) error {
+	a.records = append(a.records, rec)
+	return nil
+}
+
+func TestUpdateNamedPortsDryRunAudit(t *testing.T) {
+	auditor := &fakeAuditor{}
+	n := &NamedPort{
+		cluster: "foo",
+		planned: make(map[string]PortList),
+		logger:  config.FakeConfig().Logger,
+		auditor: auditor,
+	}
+
+	ig := &igInfo{
+		name:    "gke-foo-default-pool-1234abcd-grp",
+		zone:    "europe-west1-b",
+		project: "my-project",
+		ports:   PortList{"legacy": 1234},
+	}
+
+	// in dry-run mode, the compute client isn't used
+	if err := n.updateNamedPorts(context.Background(), PortList{"http": 8080}, ig, nil, []string{"service/default/web"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(auditor.records) != 1 {
+		t.Fatalf("Expected an audit record, got %d", len(auditor.records))
+	}
+
+	rec := auditor.records[0]
+	if !rec.DryRun || rec.Cluster != "foo" || rec.InstanceGroup != ig.name || rec.Before["legacy"] != 1234 ||
+		rec.After["http"] != 8080 || rec.After["legacy"] != 1234 || rec.Owners[0] != "service/default/web" {
+		t.Errorf("Unexpected audit record: %+v", rec)
+	}
+
+	// the same planned change isn't recorded again on later resyncs
+	if err := n.updateNamedPorts(context.Background(), PortList{"http": 8080}, ig, nil, []string{"service/default/web"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(auditor.records) != 1 {
+		t.Errorf("An unchanged planned change shouldn't be recorded again, got %d records", len(auditor.records))
+	}
+
+	// but a distinct one is
+	if err := n.updateNamedPorts(context.Background(), PortList{"http": 8081}, ig, nil, []string{"service/default/web"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(auditor.records) != 2 || auditor.records[1].After["http"] != 8081 {
+		t.Errorf("A new planned change should be recorded: %+v", auditor.records)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	n := &NamedPort{timeout: 10 * time.Millisecond}
+
+	// a hung call is interrupted by the timeout
+	err := n.call(context.Background(), "hung", nil, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("call() should time out, got %v", err)
+	}
+
+	// and caller's cancellation is honored
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.timeout = 0
+	err = n.call(ctx, "cancelled", nil, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("call() should honor the caller's context, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package namedports
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	compute "google.golang.org/api/compute/v0.beta"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	providerIDPrefix = "gce://"
+	nodePoolLabel    = "cloud.google.com/gke-nodepool"
+	createdByKey     = "created-by"
+)
+
+// igRef identifies the (zonal) instance group an instance belongs to
+type igRef struct {
+	project string
+	zone    string
+	name    string
+}
+
+// getNodesInstanceGroups finds the cluster's instance groups from the
+// Kubernetes nodes: each node's providerID points to a GCE instance,
+// whose "created-by" metadata gives the managing instance group.
+func (n *NamedPort) getNodesInstanceGroups(ctx context.Context, csvc *compute.Service) (*[]igInfo, error) {
+	var igz []igInfo
+
+	nodes, err := n.clientset.CoreV1().Nodes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return &igz, fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	seen := make(map[igRef]bool)
+	current := make(map[string]bool)
+	for _, node := range nodes.Items {
+		project, zone, instance, err := parseProviderID(node.Spec.ProviderID)
+		if err != nil {
+			n.logger.WithField("node", node.Name).Debugf("Ignoring node %s: %v", node.Name, err)
+			continue
+		}
+		current[instanceKey(project, zone, instance)] = true
+
+		ref, err := n.getInstanceGroupRef(ctx, csvc, project, zone, instance)
+		if err != nil {
+			return &igz, err
+		}
+
+		if ref.name == "" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		igroup := igInfo{
+			name:     ref.name,
+			zone:     ref.zone,
+			project:  ref.project,
+			nodePool: node.Labels[nodePoolLabel],
+			labels:   node.Labels,
+			ports:    make(PortList),
+		}
+
+		var req *compute.InstanceGroup
+		err = n.call(ctx, "compute.instanceGroups.get", igroup.attributes(), func(ctx context.Context) (err error) {
+			req, err = csvc.InstanceGroups.Get(igroup.project, igroup.zone, igroup.name).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return &igz, fmt.Errorf("failed to collect named ports: %v", err)
+		}
+		for _, port := range req.NamedPorts {
+			igroup.ports[port.Name] = port.Port
+		}
+
+		igz = append(igz, igroup)
+	}
+
+	// forget the instances of removed nodes
+	for key := range n.instances {
+		if !current[key] {
+			delete(n.instances, key)
+		}
+	}
+
+	sort.Slice(igz, func(i, j int) bool { return igz[i].name < igz[j].name })
+
+	return &igz, nil
+}
+
+// instanceKey identifies an instance in the instances cache
+func instanceKey(project, zone, instance string) string {
+	return project + "/" + zone + "/" + instance
+}
+
+// getInstanceGroupRef returns the instance group managing an instance.
+// Results are cached (while the instance's node exists), since an instance
+// can't change instance group.
+func (n *NamedPort) getInstanceGroupRef(ctx context.Context, csvc *compute.Service, project, zone, instance string) (igRef, error) {
+	key := instanceKey(project, zone, instance)
+	if ref, ok := n.instances[key]; ok {
+		return ref, nil
+	}
+
+	attrs := []attribute.KeyValue{attribute.String("instance", instance),
+		attribute.String("zone", zone), attribute.String("project", project)}
+
+	var inst *compute.Instance
+	err := n.call(ctx, "compute.instances.get", attrs, func(ctx context.Context) (err error) {
+		inst, err = csvc.Instances.Get(project, zone, instance).Fields("metadata").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return igRef{}, fmt.Errorf("failed to get instance %s: %v", instance, err)
+	}
+
+	var ref igRef
+	if inst.Metadata != nil {
+		for _, item := range inst.Metadata.Items {
+			if item.Key == createdByKey && item.Value != nil {
+				ref = parseCreatedBy(*item.Value)
+				ref.project = project
+				break
+			}
+		}
+	}
+
+	if ref.name == "" {
+		n.logger.WithFields(logrus.Fields{"instance": instance, "zone": zone, "project": project}).
+			Debugf("Instance %s isn't part of a zonal managed instance group", instance)
+	}
+
+	n.instances[key] = ref
+	return ref, nil
+}
+
+// parseProviderID splits a "gce://project/zone/instance" node providerID
+func parseProviderID(providerID string) (project, zone, instance string, err error) {
+	if !strings.HasPrefix(providerID, providerIDPrefix) {
+		return "", "", "", fmt.Errorf("not a GCE providerID: %q", providerID)
+	}
+
+	elm := strings.Split(strings.TrimPrefix(providerID, providerIDPrefix), "/")
+	if len(elm) != 3 || elm[0] == "" || elm[1] == "" || elm[2] == "" {
+		return "", "", "", fmt.Errorf("malformed GCE providerID: %q", providerID)
+	}
+
+	return elm[0], elm[1], elm[2], nil
+}
+
+// parseCreatedBy parses a "projects/<num>/zones/<zone>/instanceGroupManagers/<name>"
+// instance metadata. The managed instance group has the same name as its manager.
+func parseCreatedBy(createdBy string) igRef {
+	elm := strings.Split(createdBy, "/")
+	if len(elm) != 6 || elm[2] != "zones" || elm[4] != "instanceGroupManagers" {
+		return igRef{}
+	}
+
+	return igRef{zone: elm[3], name: elm[5]}
+}
@@ -0,0 +1,33 @@
+package namedports
+
+import (
+	"testing"
+)
+
+func TestParseProviderID(t *testing.T) {
+	project, zone, instance, err := parseProviderID("gce://my-project/europe-west1-b/gke-foo-default-pool-1234abcd-x5z9")
+	if err != nil {
+		t.Fatalf("parseProviderID failed: %v", err)
+	}
+	if project != "my-project" || zone != "europe-west1-b" || instance != "gke-foo-default-pool-1234abcd-x5z9" {
+		t.Errorf("Unexpected parseProviderID result: %s %s %s", project, zone, instance)
+	}
+
+	for _, id := range []string{"", "aws:///eu-west-1a/i-0123", "gce://my-project/europe-west1-b", "gce://my-project//foo"} {
+		if _, _, _, err = parseProviderID(id); err == nil {
+			t.Errorf("parseProviderID should fail on %q", id)
+		}
+	}
+}
+
+func TestParseCreatedBy(t *testing.T) {
+	ref := parseCreatedBy("projects/123456789/zones/europe-west1-b/instanceGroupManagers/gke-foo-default-pool-1234abcd-grp")
+	if ref.zone != "europe-west1-b" || ref.name != "gke-foo-default-pool-1234abcd-grp" {
+		t.Errorf("Unexpected parseCreatedBy result: %+v", ref)
+	}
+
+	ref = parseCreatedBy("projects/123456789/regions/europe-west1/instanceGroupManagers/foo")
+	if ref.name != "" {
+		t.Errorf("parseCreatedBy should ignore regional instance groups: %+v", ref)
+	}
+}
@@ -0,0 +1,79 @@
+package namedports
+
+import (
+	"context"
+	"sort"
+)
+
+const (
+	// ActionAdd is a named port addition
+	ActionAdd = "add"
+
+	// ActionChange is a named port value change
+	ActionChange = "change"
+)
+
+// PortChange is a named port change on an instance group. Since we keep all
+// existing named ports during updates, ports are never removed.
+type PortChange struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Before int64  `json:"before,omitempty"`
+	After  int64  `json:"after"`
+}
+
+// InstanceGroupPlan lists the changes a resync would apply on an instance group
+type InstanceGroupPlan struct {
+	Project  string       `json:"project"`
+	Zone     string       `json:"zone"`
+	Name     string       `json:"name"`
+	NodePool string       `json:"nodePool,omitempty"`
+	Changes  []PortChange `json:"changes"`
+}
+
+// Plan returns the changes ResyncNamedPorts would apply, for each instance
+// group needing changes, without applying them.
+func (n *NamedPort) Plan(ctx context.Context, expected PortList, targets TargetList) ([]InstanceGroupPlan, error) {
+	var plans []InstanceGroupPlan
+
+	igz, err := n.discover(ctx)
+	if err != nil {
+		return plans, err
+	}
+
+	for _, ig := range *igz {
+		changes := diff(targets.filter(expected, &ig), &ig)
+		if len(changes) == 0 {
+			continue
+		}
+
+		plans = append(plans, InstanceGroupPlan{
+			Project:  ig.project,
+			Zone:     ig.zone,
+			Name:     ig.name,
+			NodePool: ig.nodePool,
+			Changes:  changes,
+		})
+	}
+
+	return plans, nil
+}
+
+// diff returns the changes needed to have the wanted ports on an instance group
+func diff(wanted PortList, ig *igInfo) []PortChange {
+	var changes []PortChange
+
+	for name, port := range wanted {
+		current, ok := ig.ports[name]
+		switch {
+		case !ok:
+			changes = append(changes, PortChange{Action: ActionAdd, Name: name, After: port})
+		case current != port:
+			changes = append(changes, PortChange{Action: ActionChange, Name: name, Before: current, After: port})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+	return changes
+}
@@ -0,0 +1,37 @@
+package namedports
+
+import (
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	ig := &igInfo{ports: PortList{"http": 8080, "metrics": 9090, "foreign": 1234}}
+
+	changes := diff(PortList{"http": 8080, "metrics": 9091, "grpc": 5000}, ig)
+	if len(changes) != 2 {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	if changes[0].Action != ActionAdd || changes[0].Name != "grpc" || changes[0].After != 5000 {
+		t.Errorf("Unexpected add change: %+v", changes[0])
+	}
+	if changes[1].Action != ActionChange || changes[1].Before != 9090 || changes[1].After != 9091 {
+		t.Errorf("Unexpected change: %+v", changes[1])
+	}
+}
+
+func TestFromClaims(t *testing.T) {
+	gpu := PortTarget{NodePools: []string{"gpu-pool"}}
+	ports, targets := FromClaims([]Claim{
+		{Owner: "service/default/a", Name: "http", Port: 8080, Target: gpu},
+		{Owner: "service/default/b", Name: "http", Port: 8081},
+		{Owner: "namedport/c", Name: "gpu", Port: 9090, Target: gpu},
+		{Owner: "namedport/d", Name: "gpu", Port: 9090, Target: PortTarget{Selector: "gpu=true"}},
+	})
+
+	if len(ports) != 2 || ports["http"] != 8081 {
+		t.Errorf("Unexpected ports: %v", ports)
+	}
+	if _, ok := targets["http"]; ok || len(targets) != 1 || len(targets["gpu"]) != 2 {
+		t.Errorf("Unexpected targets: %v", targets)
+	}
+}
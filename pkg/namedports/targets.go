@@ -0,0 +1,101 @@
+package namedports
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PortTarget restricts a named port to some node pools.
+// The zero value targets all node pools.
+type PortTarget struct {
+	// NodePools lists the targeted node pools names
+	NodePools []string `json:"nodePools,omitempty"`
+
+	// Selector is a label selector on node pools labels
+	Selector string `json:"selector,omitempty"`
+}
+
+// TargetList holds ports targets, by port name: a port is expected on the node
+// pools matching any of its targets (ie. declared by several owners). Ports not
+// listed there are expected on all node pools.
+type TargetList map[string][]PortTarget
+
+// ParsePortTarget builds a PortTarget from a comma separated node pools
+// list, and/or a node pools label selector.
+func ParsePortTarget(pools, selector string) (PortTarget, error) {
+	var target PortTarget
+
+	for _, pool := range strings.Split(pools, ",") {
+		if pool = strings.TrimSpace(pool); pool != "" {
+			target.NodePools = append(target.NodePools, pool)
+		}
+	}
+
+	if selector = strings.TrimSpace(selector); selector != "" {
+		if _, err := labels.Parse(selector); err != nil {
+			return target, fmt.Errorf("invalid node pools selector %q: %v", selector, err)
+		}
+		target.Selector = selector
+	}
+
+	return target, nil
+}
+
+// IsZero tells if the target applies to all node pools
+func (t PortTarget) IsZero() bool {
+	return len(t.NodePools) == 0 && t.Selector == ""
+}
+
+// Matches tells if a node pool, given its name and labels, is targeted.
+// When both node pools names and selector are set, both must match.
+func (t PortTarget) Matches(pool string, poolLabels map[string]string) bool {
+	if len(t.NodePools) > 0 {
+		found := false
+		for _, p := range t.NodePools {
+			if p == pool {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if t.Selector != "" {
+		sel, err := labels.Parse(t.Selector)
+		if err != nil || !sel.Matches(labels.Set(poolLabels)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matches tells if a port targets a node pool
+func (t TargetList) matches(name string, pool string, poolLabels map[string]string) bool {
+	targets, ok := t[name]
+	if !ok {
+		return true
+	}
+
+	for _, target := range targets {
+		if target.Matches(pool, poolLabels) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the expected ports targeting the provided instance group
+func (t TargetList) filter(expected PortList, ig *igInfo) PortList {
+	ports := make(PortList)
+	for name, port := range expected {
+		if t.matches(name, ig.nodePool, ig.labels) {
+			ports[name] = port
+		}
+	}
+	return ports
+}
@@ -0,0 +1,62 @@
+package namedports
+
+import (
+	"testing"
+)
+
+func TestPortTarget(t *testing.T) {
+	target, err := ParsePortTarget(" gpu-pool, ,other ", "")
+	if err != nil {
+		t.Fatalf("ParsePortTarget failed: %v", err)
+	}
+	if len(target.NodePools) != 2 || target.NodePools[1] != "other" {
+		t.Errorf("Unexpected node pools: %v", target.NodePools)
+	}
+	if !target.Matches("gpu-pool", nil) || target.Matches("default-pool", nil) {
+		t.Error("Node pools names target doesn't match as expected")
+	}
+
+	if _, err = ParsePortTarget("", "foo in (bar"); err == nil {
+		t.Error("ParsePortTarget should fail on invalid selectors")
+	}
+
+	target, err = ParsePortTarget("", "accelerator=gpu")
+	if err != nil {
+		t.Fatalf("ParsePortTarget failed: %v", err)
+	}
+	if !target.Matches("any", map[string]string{"accelerator": "gpu"}) {
+		t.Error("Selector target should match labelled node pools")
+	}
+	if target.Matches("any", map[string]string{"accelerator": "none"}) {
+		t.Error("Selector target shouldn't match unlabelled node pools")
+	}
+
+	target, _ = ParsePortTarget("", "")
+	if !target.IsZero() || !target.Matches("any", nil) {
+		t.Error("Zero target should match all node pools")
+	}
+}
+
+func TestTargetListFilter(t *testing.T) {
+	targets := TargetList{
+		"gpu":     {{NodePools: []string{"gpu-pool"}}},
+		"metrics": {{NodePools: []string{"gpu-pool"}}, {Selector: "env=prod"}},
+	}
+	expected := PortList{"gpu": 9090, "http": 8080, "metrics": 9100}
+
+	ports := targets.filter(expected, &igInfo{nodePool: "default-pool"})
+	if len(ports) != 1 || ports["http"] != 8080 {
+		t.Errorf("Unexpected ports for default-pool: %v", ports)
+	}
+
+	ports = targets.filter(expected, &igInfo{nodePool: "gpu-pool"})
+	if len(ports) != 3 {
+		t.Errorf("Unexpected ports for gpu-pool: %v", ports)
+	}
+
+	// ports with several targets are expected on node pools matching any of them
+	ports = targets.filter(expected, &igInfo{nodePool: "prod-pool", labels: map[string]string{"env": "prod"}})
+	if len(ports) != 2 || ports["metrics"] != 9100 {
+		t.Errorf("Unexpected ports for prod-pool: %v", ports)
+	}
+}
@@ -0,0 +1,69 @@
+package namedports
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	compute "google.golang.org/api/compute/v0.beta"
+)
+
+// getUnmanagedInstanceGroups lists the project's zonal instance groups whose
+// name matches the unmanaged instance groups pattern. Those groups have no node
+// pool: we use the instance group name as node pool name, so ports targets can
+// name them.
+func (n *NamedPort) getUnmanagedInstanceGroups(ctx context.Context, csvc *compute.Service) (*[]igInfo, error) {
+	var igz []igInfo
+
+	collect := func(list *compute.InstanceGroupAggregatedList) error {
+		for _, scoped := range list.Items {
+			for _, ig := range scoped.InstanceGroups {
+				// regional instance groups have no zone, and aren't supported
+				if ig.Zone == "" || !n.unmanaged.MatchString(ig.Name) {
+					continue
+				}
+
+				igroup := igInfo{
+					name:     ig.Name,
+					zone:     ig.Zone[strings.LastIndex(ig.Zone, "/")+1:],
+					project:  n.project,
+					nodePool: ig.Name,
+					ports:    make(PortList),
+				}
+				for _, port := range ig.NamedPorts {
+					igroup.ports[port.Name] = port.Port
+				}
+
+				igz = append(igz, igroup)
+			}
+		}
+		return nil
+	}
+
+	attrs := []attribute.KeyValue{attribute.String("project", n.project)}
+	err := n.call(ctx, "compute.instanceGroups.aggregatedList", attrs, func(ctx context.Context) error {
+		igz = nil // on retries
+		return csvc.InstanceGroups.AggregatedList(n.project).Pages(ctx, collect)
+	})
+
+	if err != nil {
+		return &igz, fmt.Errorf("failed to list unmanaged instance groups: %v", err)
+	}
+
+	return &igz, nil
+}
+
+// mergeInstanceGroups appends instance groups not already known
+func mergeInstanceGroups(igz *[]igInfo, extra *[]igInfo) {
+	known := make(map[string]bool)
+	for _, ig := range *igz {
+		known[ig.project+"/"+ig.zone+"/"+ig.name] = true
+	}
+
+	for _, ig := range *extra {
+		if !known[ig.project+"/"+ig.zone+"/"+ig.name] {
+			*igz = append(*igz, ig)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package namedports
+
+import (
+	"testing"
+)
+
+func TestMergeInstanceGroups(t *testing.T) {
+	igz := &[]igInfo{{name: "foo", zone: "europe-west1-b"}}
+	extra := &[]igInfo{
+		{name: "foo", zone: "europe-west1-b"},
+		{name: "foo", zone: "europe-west1-c"},
+		{name: "legacy", zone: "europe-west1-b"},
+	}
+
+	mergeInstanceGroups(igz, extra)
+	if len(*igz) != 3 {
+		t.Errorf("mergeInstanceGroups should skip already known instance groups: %+v", *igz)
+	}
+}
@@ -0,0 +1,229 @@
+// Package nodes watchs for nodes, to resync named ports as soon as new
+// instance groups appear.
+package nodes
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/worker"
+)
+
+var (
+	zoneLabels = []string{
+		"topology.kubernetes.io/zone",
+		"failure-domain.beta.kubernetes.io/zone",
+	}
+
+	nodePoolLabel = "cloud.google.com/gke-nodepool"
+)
+
+// Controller watches nodes, and triggers an immediate resync when nodes
+// from a previously unseen instance group appear (ie. on node pools
+// creation, or when a node pool is recreated).
+type Controller struct {
+	conf      *config.KnpConfig
+	informer  cache.SharedIndexInformer
+	listWatch cache.ListerWatcher
+	stopCh    chan struct{}
+	worker    worker.Worker
+	wg        *sync.WaitGroup
+	initMu    sync.Mutex
+	syncInit  bool
+	seenMu    sync.Mutex
+	seen      map[string]bool
+	synced    bool
+}
+
+// NewController creates and initialize the nodes controller
+func NewController(conf *config.KnpConfig, w worker.Worker) *Controller {
+	c := &Controller{
+		conf:   conf,
+		worker: w,
+		seen:   make(map[string]bool),
+	}
+
+	client := c.conf.ClientSet
+	c.listWatch = &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Nodes().List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Nodes().Watch(options)
+		},
+	}
+
+	return c
+}
+
+// Start initialize and launch a controller. The sync.WaitGroup
+// argument is expected to be aknowledged (Done()) at controller
+// termination, when Stop() is called.
+func (c *Controller) Start(wg *sync.WaitGroup) {
+	c.conf.Logger.Infof("Starting nodes controller")
+
+	c.stopCh = make(chan struct{})
+
+	c.wg = wg
+
+	c.initMu.Lock()
+	c.syncInit = true
+	c.initMu.Unlock()
+
+	c.startInformer()
+
+	go c.run(c.stopCh)
+
+	<-c.stopCh
+}
+
+// Stop ends a controller and notify the controller's WaitGroup
+func (c *Controller) Stop() {
+	c.conf.Logger.Infof("Stopping nodes controller")
+
+	// don't stop while we're still starting
+	c.initMu.Lock()
+	for !c.syncInit {
+		time.Sleep(time.Millisecond)
+	}
+	c.initMu.Unlock()
+
+	close(c.stopCh)
+	c.wg.Done()
+}
+
+func (c *Controller) startInformer() {
+	c.informer = cache.NewSharedIndexInformer(
+		c.listWatch,
+		&core_v1.Node{},
+		0, // only new nodes matter
+		cache.Indexers{},
+	)
+
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.observe(obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			c.observe(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.forget(obj)
+		},
+	})
+}
+
+func (c *Controller) run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	go c.informer.Run(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
+		return
+	}
+
+	// nodes seen during the initial listing are handled by the regular resyncs
+	c.seenMu.Lock()
+	c.synced = true
+	c.seenMu.Unlock()
+
+	c.conf.Logger.Infof("nodes controller synced and ready")
+}
+
+// observe records a node's instance group, and triggers a resync when
+// that instance group wasn't seen before.
+func (c *Controller) observe(obj interface{}) {
+	node, ok := obj.(*core_v1.Node)
+	if !ok {
+		return
+	}
+
+	key := instanceGroupKey(node)
+	if key == "" {
+		return
+	}
+
+	c.seenMu.Lock()
+	known, synced := c.seen[key], c.synced
+	c.seen[key] = true
+	c.seenMu.Unlock()
+
+	if known || !synced {
+		return
+	}
+
+	c.conf.Logger.Infof("Node %s belongs to a new instance group (%s), resyncing named ports", node.Name, key)
+	c.worker.Trigger()
+}
+
+// forget drops a deleted node's instance group once none of its nodes remain,
+// so a recreated node pool (or instance group) triggers a resync again.
+func (c *Controller) forget(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	node, ok := obj.(*core_v1.Node)
+	if !ok {
+		return
+	}
+
+	key := instanceGroupKey(node)
+	if key == "" {
+		return
+	}
+
+	for _, other := range c.informer.GetStore().List() {
+		if instanceGroupKey(other.(*core_v1.Node)) == key {
+			return
+		}
+	}
+
+	c.seenMu.Lock()
+	delete(c.seen, key)
+	c.seenMu.Unlock()
+}
+
+// instanceGroupKey identifies the instance group a node belongs to, without
+// calling GCP APIs. Managed instance groups name their instances after a common
+// base name followed by a random suffix ("<base>-<suffix>"). On GKE, that base
+// name carries a per instance group hash ("gke-<cluster>-<pool>-<hash>"), so
+// instance groups recreated by upgrades get new keys, even while nodes from the
+// previous ones remain. GKE nodes are keyed on their node pool, zone and base
+// name; other nodes (ie. self-managed clusters using the nodes discovery) on
+// their zone and base name. Nodes matching neither get no key.
+func instanceGroupKey(node *core_v1.Node) string {
+	zone := ""
+	for _, label := range zoneLabels {
+		if z, ok := node.Labels[label]; ok {
+			zone = z
+			break
+		}
+	}
+
+	base := ""
+	if idx := strings.LastIndex(node.Name, "-"); idx > 0 {
+		base = node.Name[:idx]
+	}
+
+	if pool := node.Labels[nodePoolLabel]; pool != "" {
+		return zone + "/pool/" + pool + "/" + base
+	}
+
+	if base == "" {
+		return ""
+	}
+
+	return zone + "/name/" + base
+}
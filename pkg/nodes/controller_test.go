@@ -0,0 +1,117 @@
+package nodes
+
+import (
+	"sync"
+	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/worker"
+)
+
+type fakeWorker struct {
+	mu       sync.Mutex
+	triggers int
+}
+
+func (w *fakeWorker) Start()                                             {}
+func (w *fakeWorker) Stop()                                              {}
+func (w *fakeWorker) Add(name string, port int64)                        {}
+func (w *fakeWorker) AddMap(ports np.PortList)                           {}
+func (w *fakeWorker) SetTarget(owner, name string, target np.PortTarget) {}
+func (w *fakeWorker) OnSync(handler worker.SyncHandler)                  {}
+func (w *fakeWorker) SetOwnedPorts(owner string, names []string)         {}
+
+func (w *fakeWorker) Trigger() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.triggers++
+}
+
+func newNode(name, zone string) *core_v1.Node {
+	return &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{zoneLabels[1]: zone},
+		},
+	}
+}
+
+func newPoolNode(name, zone, pool string) *core_v1.Node {
+	node := newNode(name, zone)
+	node.Labels[nodePoolLabel] = pool
+	return node
+}
+
+func TestInstanceGroupKey(t *testing.T) {
+	key := instanceGroupKey(newPoolNode("gke-foo-default-pool-1e4b2c3d-x2kq", "europe-west1-b", "default-pool"))
+	if key != "europe-west1-b/pool/default-pool/gke-foo-default-pool-1e4b2c3d" {
+		t.Errorf("Unexpected instance group key: %q", key)
+	}
+
+	// nodes without node pool label fall back to their instance group base name
+	key = instanceGroupKey(newNode("legacy-nodes-x2kq", "europe-west1-b"))
+	if key != "europe-west1-b/name/legacy-nodes" {
+		t.Errorf("Unexpected fallback instance group key: %q", key)
+	}
+
+	if key = instanceGroupKey(newNode("minikube", "")); key != "" {
+		t.Errorf("Nodes without pool nor suffix shouldn't have an instance group key: %q", key)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	w := &fakeWorker{}
+	c := NewController(config.FakeConfig(), w)
+	c.startInformer()
+
+	// nodes seen before the initial sync don't trigger resyncs
+	c.observe(newPoolNode("gke-foo-default-pool-1e4b2c3d-x2kq", "europe-west1-b", "default-pool"))
+	c.synced = true
+
+	for _, node := range []*core_v1.Node{
+		newPoolNode("gke-foo-default-pool-1e4b2c3d-a1b2", "europe-west1-b", "default-pool"),
+		newPoolNode("gke-foo-default-pool-5a6b7c8d-a1b2", "europe-west1-c", "default-pool"),
+		newPoolNode("gke-foo-gpu-pool-9f8e7d6c-c3d4", "europe-west1-b", "gpu-pool"),
+		newPoolNode("gke-foo-gpu-pool-9f8e7d6c-e5f6", "europe-west1-b", "gpu-pool"),
+		newNode("legacy-nodes-g7h8", "europe-west1-b"),
+		newNode("legacy-nodes-i9j0", "europe-west1-b"),
+	} {
+		c.observe(node)
+	}
+
+	if w.triggers != 3 {
+		t.Errorf("Expected 3 resyncs triggers, got %d", w.triggers)
+	}
+
+	// a GKE upgrade recreates the instance groups: new nodes trigger a resync
+	// while the previous instance group's nodes are still there
+	c.observe(newPoolNode("gke-foo-gpu-pool-0a1b2c3d-k1l2", "europe-west1-b", "gpu-pool"))
+	if w.triggers != 4 {
+		t.Errorf("A recreated instance group should trigger a resync, got %d triggers", w.triggers)
+	}
+
+	// instance groups are forgotten once all their nodes are gone
+	gpu := newPoolNode("gke-foo-gpu-pool-9f8e7d6c-c3d4", "europe-west1-b", "gpu-pool")
+	if err := c.informer.GetStore().Add(newPoolNode("gke-foo-gpu-pool-9f8e7d6c-e5f6", "europe-west1-b", "gpu-pool")); err != nil {
+		t.Fatal(err)
+	}
+	c.forget(gpu)
+	c.observe(gpu)
+	if w.triggers != 4 {
+		t.Errorf("Instance groups with remaining nodes shouldn't be forgotten, got %d triggers", w.triggers)
+	}
+
+	if err := c.informer.GetStore().Delete(newPoolNode("gke-foo-gpu-pool-9f8e7d6c-e5f6", "europe-west1-b", "gpu-pool")); err != nil {
+		t.Fatal(err)
+	}
+	c.forget(cache.DeletedFinalStateUnknown{Key: "gke-foo-gpu-pool-9f8e7d6c-e5f6", Obj: gpu})
+	c.observe(gpu)
+	if w.triggers != 5 {
+		t.Errorf("Instance groups without nodes should be forgotten, got %d triggers", w.triggers)
+	}
+}
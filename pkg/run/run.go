@@ -9,23 +9,46 @@ import (
 	"syscall"
 
 	"github.com/bpineau/kube-named-ports/config"
+	"github.com/bpineau/kube-named-ports/pkg/crd"
 	"github.com/bpineau/kube-named-ports/pkg/health"
+	"github.com/bpineau/kube-named-ports/pkg/nodes"
 	"github.com/bpineau/kube-named-ports/pkg/services"
 	"github.com/bpineau/kube-named-ports/pkg/worker"
 )
 
-// Run launchs the effective services controllers goroutines
-func Run(config *config.KnpConfig) {
+// Run launchs the effective services controllers goroutines, with
+// a distinct controllers and worker set for each provided cluster.
+func Run(configs ...*config.KnpConfig) {
 	wg := sync.WaitGroup{}
-	wg.Add(1)
 	defer wg.Wait()
 
-	wrk := worker.NewWorker(config)
-	svc := services.NewController(config, wrk)
-	go svc.Start(&wg)
-	defer func(s *services.Controller) {
-		go s.Stop()
-	}(svc)
+	for _, conf := range configs {
+		wg.Add(1)
+		wrk := worker.NewWorker(conf)
+		svc := services.NewController(conf, wrk)
+		go svc.Start(&wg)
+		defer func(s *services.Controller) {
+			go s.Stop()
+		}(svc)
+
+		wg.Add(1)
+		nodesCtrl := nodes.NewController(conf, wrk)
+		go nodesCtrl.Start(&wg)
+		defer func(c *nodes.Controller) {
+			go c.Stop()
+		}(nodesCtrl)
+
+		if conf.NamedPortCRD {
+			wg.Add(1)
+			np := crd.NewController(conf, wrk)
+			go np.Start(&wg)
+			defer func(c *crd.Controller) {
+				go c.Stop()
+			}(np)
+		}
+	}
+
+	config := configs[0]
 
 	go func() {
 		if err := health.HeartBeatService(config); err != nil {
@@ -38,5 +61,5 @@ func Run(config *config.KnpConfig) {
 	signal.Notify(sigterm, syscall.SIGINT)
 	<-sigterm
 
-	config.Logger.Infof("Stopping the service controller")
+	config.Logger.Infof("Stopping the controllers, waiting up to %v for ongoing resyncs", config.ShutdownGrace)
 }
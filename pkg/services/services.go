@@ -2,18 +2,26 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
 	"github.com/bpineau/kube-named-ports/pkg/worker"
 
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	core_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
@@ -22,12 +30,32 @@ import (
 )
 
 var (
-	maxProcessRetry          = 6
-	namedPortNameAnnotation  = "kube-named-ports.io/port-name"
-	namedPortValueAnnotation = "kube-named-ports.io/port-value"
-	namedPortMapAnnotation   = "kube-named-ports.io/port-map"
+	maxProcessRetry            = 6
+	resyncTick                 = time.Second
+	statusRefreshInterval      = 30 * time.Minute
+	annotationsPrefix          = "kube-named-ports.io/"
+	namedPortNameAnnotation    = "kube-named-ports.io/port-name"
+	namedPortValueAnnotation   = "kube-named-ports.io/port-value"
+	namedPortMapAnnotation     = "kube-named-ports.io/port-map"
+	namedPortStatusAnnotation  = "kube-named-ports.io/status"
+	nodePoolsAnnotation        = "kube-named-ports.io/node-pools"
+	nodePoolSelectorAnnotation = "kube-named-ports.io/node-pool-selector"
 )
 
+// syncStatus is the resync outcome we report in services annotations
+type syncStatus struct {
+	// InstanceGroups lists, by port name, the instance groups having the named port
+	InstanceGroups map[string][]string `json:"instanceGroups"`
+
+	// LastSync is the last resync time, RFC3339 formatted. To avoid patching
+	// services on every resync, it's only refreshed when the outcome changes,
+	// or after statusRefreshInterval.
+	LastSync string `json:"lastSync"`
+
+	// Error is the last resync error, if any
+	Error string `json:"error,omitempty"`
+}
+
 // Controller are started in a persistent goroutine at program launch,
 // and are responsible for watching resources, and for calling worker
 // when those resources changes.
@@ -78,7 +106,9 @@ func (c *Controller) Start(wg *sync.WaitGroup) {
 	c.initMu.Unlock()
 
 	c.startInformer()
+	c.conf.OnReload(c.requeueAll)
 
+	c.worker.OnSync(c.updateStatus)
 	c.worker.Start()
 	go c.run(c.stopCh)
 
@@ -97,10 +127,9 @@ func (c *Controller) Stop() {
 	c.initMu.Unlock()
 
 	close(c.stopCh)
-	c.worker.Stop()
 
-	// give everything 0.2s max to stop gracefully
-	time.Sleep(200 * time.Millisecond)
+	// wait for the ongoing named ports changes, up to the shutdown grace period
+	c.worker.Stop()
 
 	c.wg.Done()
 }
@@ -111,7 +140,7 @@ func (c *Controller) startInformer() {
 	c.informer = cache.NewSharedIndexInformer(
 		c.listWatch,
 		&core_v1.Service{},
-		c.conf.ResyncIntv,
+		0, // resyncs are handled by resyncLoop, as the interval can be reloaded
 		cache.Indexers{},
 	)
 
@@ -150,9 +179,37 @@ func (c *Controller) run(stopCh <-chan struct{}) {
 
 	c.conf.Logger.Infof("services controller synced and ready")
 
+	go c.resyncLoop(stopCh)
+
 	wait.Until(c.runWorker, time.Second, stopCh)
 }
 
+// resyncLoop requeues all services once per resync interval. The interval is
+// checked on each tick, as configuration reloads may change it.
+func (c *Controller) resyncLoop(stopCh <-chan struct{}) {
+	last := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(resyncTick):
+		}
+
+		intv := c.conf.ResyncInterval()
+		if intv > 0 && time.Since(last) >= intv {
+			c.requeueAll()
+			last = time.Now()
+		}
+	}
+}
+
+// requeueAll queues all known services for processing
+func (c *Controller) requeueAll() {
+	for _, key := range c.informer.GetIndexer().ListKeys() {
+		c.queue.Add(key)
+	}
+}
+
 func (c *Controller) runWorker() {
 	for c.processNextItem() {
 		// continue looping
@@ -166,17 +223,19 @@ func (c *Controller) processNextItem() bool {
 	}
 	defer c.queue.Done(key)
 
+	_, span := tracing.Start(context.Background(), "services.processItem", attribute.String("service", key.(string)))
 	err := c.processItem(key.(string))
+	tracing.End(span, err)
 
 	if err == nil {
 		// No error, reset the ratelimit counters
 		c.queue.Forget(key)
 	} else if c.queue.NumRequeues(key) < maxProcessRetry {
-		c.conf.Logger.Errorf("Error processing %s (will retry): %v", key, err)
+		c.conf.Logger.WithField("service", key).Errorf("Error processing %s (will retry): %v", key, err)
 		c.queue.AddRateLimited(key)
 	} else {
 		// err != nil and too many retries
-		c.conf.Logger.Errorf("Error processing %s (giving up): %v", key, err)
+		c.conf.Logger.WithField("service", key).Errorf("Error processing %s (giving up): %v", key, err)
 		c.queue.Forget(key)
 	}
 
@@ -191,35 +250,263 @@ func (c *Controller) processItem(key string) error {
 	}
 
 	if !exist {
-		return fmt.Errorf("Object doesn't exist anymore with key %s", key)
+		// the service was deleted: forget the owner
+		c.worker.SetOwnedPorts("service/"+key, nil)
+		return nil
 	}
 
 	svc := obj.(*core_v1.Service)
 
+	if !c.conf.WatchesNamespace(svc.Namespace) {
+		// forget the owner: its ports are no longer expected, but aren't removed from instance groups
+		c.worker.SetOwnedPorts("service/"+key, nil)
+		return nil
+	}
+
+	ports, err := portsFromService(svc)
+	if err != nil {
+		return err
+	}
+
+	if len(ports) == 0 {
+		// the named ports annotations were removed: forget the owner
+		c.worker.SetOwnedPorts("service/"+key, nil)
+		return nil
+	}
+
+	target, err := np.ParsePortTarget(svc.Annotations[nodePoolsAnnotation],
+		svc.Annotations[nodePoolSelectorAnnotation])
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name, port := range ports {
+		c.conf.Logger.WithFields(logrus.Fields{"service": key, "port_name": name}).
+			Debugf("Service %s declares named port %s->%d", key, name, port)
+		c.worker.SetTarget("service/"+key, name, target)
+		names = append(names, name)
+	}
+	c.worker.SetOwnedPorts("service/"+key, names)
+	c.worker.AddMap(ports)
+
+	return nil
+}
+
+// ListClaims lists the named ports declared by services annotations, in one go
+// (without watching). Used by one-shot commands. Services with invalid
+// annotations, or in filtered out namespaces, are ignored, as the controller does.
+func ListClaims(conf *config.KnpConfig) ([]np.Claim, error) {
+	var claims []np.Claim
+
+	list, err := conf.ClientSet.CoreV1().Services(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list services: %v", err)
+	}
+
+	for i := range list.Items {
+		svc := &list.Items[i]
+		key := svc.Namespace + "/" + svc.Name
+
+		if !conf.WatchesNamespace(svc.Namespace) {
+			continue
+		}
+
+		// like the controller, we skip invalid services
+		svcClaims, err := ServiceClaims(svc)
+		if err != nil {
+			conf.Logger.WithField("service", key).Warningf("Ignoring service %s: %v", key, err)
+			continue
+		}
+
+		claims = append(claims, svcClaims...)
+	}
+
+	return claims, nil
+}
+
+// ServiceClaims returns the named ports declared by a service's annotations,
+// parsed as the controller does.
+func ServiceClaims(svc *core_v1.Service) ([]np.Claim, error) {
+	var claims []np.Claim
+
+	ports, err := portsFromService(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := np.ParsePortTarget(svc.Annotations[nodePoolsAnnotation],
+		svc.Annotations[nodePoolSelectorAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	owner := "service/" + svc.Namespace + "/" + svc.Name
+	for name, port := range ports {
+		claims = append(claims, np.Claim{Owner: owner, Name: name, Port: port, Target: target})
+	}
+
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Name < claims[j].Name })
+
+	return claims, nil
+}
+
+// CheckAnnotations reports annotations issues the controller silently ignores:
+// unknown kube-named-ports.io annotations, and incomplete port name/value pairs.
+func CheckAnnotations(svc *core_v1.Service) []error {
+	var errs []error
+
+	known := map[string]bool{
+		namedPortNameAnnotation:    true,
+		namedPortValueAnnotation:   true,
+		namedPortMapAnnotation:     true,
+		namedPortStatusAnnotation:  true,
+		nodePoolsAnnotation:        true,
+		nodePoolSelectorAnnotation: true,
+	}
+
+	for key := range svc.Annotations {
+		if strings.HasPrefix(key, annotationsPrefix) && !known[key] {
+			errs = append(errs, fmt.Errorf("unknown annotation %q", key))
+		}
+	}
+
+	_, hasName := svc.Annotations[namedPortNameAnnotation]
+	_, hasValue := svc.Annotations[namedPortValueAnnotation]
+	if hasName != hasValue {
+		errs = append(errs, fmt.Errorf("%s and %s annotations should be used together",
+			namedPortNameAnnotation, namedPortValueAnnotation))
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return errs
+}
+
+// portsFromService returns the named ports declared by a service's annotations
+func portsFromService(svc *core_v1.Service) (np.PortList, error) {
+	ports := make(np.PortList)
+
 	rawMap, ok := svc.Annotations[namedPortMapAnnotation]
 	if ok {
-		var portMap map[string]int64
-		if err = json.Unmarshal([]byte(rawMap), &portMap); err != nil {
-			return fmt.Errorf("Failed to unmarshal port-map: %v", err)
+		if err := json.Unmarshal([]byte(rawMap), &ports); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal port-map: %v", err)
 		}
-		c.worker.AddMap(portMap)
 	}
 
 	portName, ok := svc.Annotations[namedPortNameAnnotation]
 	if !ok {
-		return nil
+		return ports, validatePorts(ports)
 	}
 
 	val, res := svc.Annotations[namedPortValueAnnotation]
 	if !res {
-		return nil
+		return ports, validatePorts(ports)
 	}
 
 	portValue, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
-		return fmt.Errorf("Failed to parse port value '%s' annotation %v", val, err)
+		return nil, fmt.Errorf("Failed to parse port value '%s' annotation %v", val, err)
 	}
 
-	c.worker.Add(portName, portValue)
+	ports[portName] = portValue
+	return ports, validatePorts(ports)
+}
+
+// validatePorts checks the ports names and values are acceptable for GCP
+func validatePorts(ports np.PortList) error {
+	for name, port := range ports {
+		if err := np.ValidatePort(name, port); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// updateStatus reports the resync outcome in an annotation, on each
+// service declaring named ports.
+func (c *Controller) updateStatus(status np.SyncStatus, err error) {
+	now := time.Now().UTC()
+
+	for _, obj := range c.informer.GetStore().List() {
+		svc := obj.(*core_v1.Service)
+		if !c.conf.WatchesNamespace(svc.Namespace) {
+			continue
+		}
+
+		ports, perr := portsFromService(svc)
+		if perr != nil || len(ports) == 0 {
+			continue
+		}
+
+		st := syncStatus{
+			InstanceGroups: make(map[string][]string),
+			LastSync:       now.Format(time.RFC3339),
+		}
+		if err != nil {
+			st.Error = err.Error()
+		}
+		for name := range ports {
+			igs := append([]string{}, status[name]...)
+			sort.Strings(igs)
+			st.InstanceGroups[name] = igs
+		}
+
+		if !statusOutdated(svc.Annotations[namedPortStatusAnnotation], &st, now) {
+			continue
+		}
+
+		if perr = c.patchStatus(svc, &st); perr != nil {
+			c.conf.Logger.WithField("service", svc.Namespace+"/"+svc.Name).
+				Errorf("Failed to update %s/%s status: %v", svc.Namespace, svc.Name, perr)
+		}
+	}
+}
+
+// statusOutdated tells if the current status annotation should be replaced by st:
+// when the instance groups or error differ, or after statusRefreshInterval.
+func statusOutdated(current string, st *syncStatus, now time.Time) bool {
+	var cur syncStatus
+	if err := json.Unmarshal([]byte(current), &cur); err != nil {
+		return true
+	}
+
+	last, err := time.Parse(time.RFC3339, cur.LastSync)
+	if err != nil || now.Sub(last) >= statusRefreshInterval {
+		return true
+	}
+
+	if cur.Error != st.Error || len(cur.InstanceGroups) != len(st.InstanceGroups) {
+		return true
+	}
+
+	for name, igs := range st.InstanceGroups {
+		curIgs, ok := cur.InstanceGroups[name]
+		if !ok || strings.Join(curIgs, ",") != strings.Join(igs, ",") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Controller) patchStatus(svc *core_v1.Service, st *syncStatus) error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				namedPortStatusAnnotation: string(raw),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conf.ClientSet.CoreV1().Services(svc.Namespace).Patch(svc.Name, types.MergePatchType, patch)
+	return err
+}
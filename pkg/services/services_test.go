@@ -0,0 +1,263 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/worker"
+)
+
+type fakeWorker struct {
+	owned map[string][]string
+}
+
+func (w *fakeWorker) Start()                                             {}
+func (w *fakeWorker) Stop()                                              {}
+func (w *fakeWorker) Add(name string, port int64)                        {}
+func (w *fakeWorker) AddMap(ports np.PortList)                           {}
+func (w *fakeWorker) SetTarget(owner, name string, target np.PortTarget) {}
+func (w *fakeWorker) OnSync(handler worker.SyncHandler)                  {}
+func (w *fakeWorker) Trigger()                                           {}
+
+func (w *fakeWorker) SetOwnedPorts(owner string, names []string) {
+	if len(names) == 0 {
+		delete(w.owned, owner)
+		return
+	}
+	w.owned[owner] = names
+}
+
+func newService(name string, annotations map[string]string) *core_v1.Service {
+	return &core_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestPortsFromService(t *testing.T) {
+	svc := newService("foo", map[string]string{
+		namedPortNameAnnotation:  "http",
+		namedPortValueAnnotation: "8080",
+		namedPortMapAnnotation:   `{"foo": 1234, "bar": 5678}`,
+	})
+	ports, err := portsFromService(svc)
+	if err != nil {
+		t.Fatalf("portsFromService failed: %v", err)
+	}
+	if len(ports) != 3 || ports["http"] != 8080 || ports["bar"] != 5678 {
+		t.Errorf("Unexpected ports: %v", ports)
+	}
+
+	svc = newService("foo", map[string]string{namedPortMapAnnotation: "{"})
+	if _, err = portsFromService(svc); err == nil {
+		t.Error("portsFromService should fail on invalid port-map")
+	}
+
+	svc = newService("foo", map[string]string{
+		namedPortNameAnnotation:  "http",
+		namedPortValueAnnotation: "eighty",
+	})
+	if _, err = portsFromService(svc); err == nil {
+		t.Error("portsFromService should fail on invalid port value")
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	conf := config.FakeConfig(
+		newService("foo", map[string]string{namedPortMapAnnotation: `{"http": 8080}`}),
+		newService("bar", nil),
+	)
+
+	c := NewController(conf, worker.NewWorker(conf))
+	c.startInformer()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		t.Fatal("Timed out waiting for caches to sync")
+	}
+
+	c.updateStatus(np.SyncStatus{"http": {"ig-b", "ig-a"}}, fmt.Errorf("boom"))
+
+	svc, err := conf.ClientSet.CoreV1().Services("default").Get("foo", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st syncStatus
+	if err = json.Unmarshal([]byte(svc.Annotations[namedPortStatusAnnotation]), &st); err != nil {
+		t.Fatalf("Failed to unmarshal status annotation: %v", err)
+	}
+	igs := st.InstanceGroups["http"]
+	if len(igs) != 2 || igs[0] != "ig-a" || st.Error != "boom" || st.LastSync == "" {
+		t.Errorf("Unexpected status annotation: %+v", st)
+	}
+
+	svc, err = conf.ClientSet.CoreV1().Services("default").Get("bar", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svc.Annotations[namedPortStatusAnnotation]; ok {
+		t.Error("Services without named ports shouldn't get a status annotation")
+	}
+
+	// wait for the informer to see the status annotation
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		obj, exists, err := c.informer.GetStore().GetByKey("default/foo")
+		if err != nil || !exists {
+			return false, err
+		}
+		_, ok := obj.(*core_v1.Service).Annotations[namedPortStatusAnnotation]
+		return ok, nil
+	})
+	if err != nil {
+		t.Fatalf("The informer didn't get the status annotation: %v", err)
+	}
+
+	cs := conf.ClientSet.(*fake.Clientset)
+	cs.ClearActions()
+	c.updateStatus(np.SyncStatus{"http": {"ig-a", "ig-b"}}, fmt.Errorf("boom"))
+	if len(cs.Actions()) != 0 {
+		t.Errorf("An unchanged status shouldn't be patched, got %v", cs.Actions())
+	}
+
+	c.updateStatus(np.SyncStatus{"http": {"ig-a", "ig-b"}}, nil)
+	if len(cs.Actions()) != 1 || cs.Actions()[0].GetVerb() != "patch" {
+		t.Errorf("A changed status should be patched, got %v", cs.Actions())
+	}
+}
+
+func TestStatusOutdated(t *testing.T) {
+	now := time.Now().UTC()
+	st := &syncStatus{InstanceGroups: map[string][]string{"http": {"ig-a"}}}
+
+	current := `{"instanceGroups":{"http":["ig-a"]},"lastSync":"` + now.Add(-time.Minute).Format(time.RFC3339) + `"}`
+	if statusOutdated(current, st, now) {
+		t.Error("A recent, identical status isn't outdated")
+	}
+
+	stale := `{"instanceGroups":{"http":["ig-a"]},"lastSync":"` + now.Add(-2*statusRefreshInterval).Format(time.RFC3339) + `"}`
+	changed := `{"instanceGroups":{"http":["ig-b"]},"lastSync":"` + now.Format(time.RFC3339) + `"}`
+	failed := `{"instanceGroups":{"http":["ig-a"]},"lastSync":"` + now.Format(time.RFC3339) + `","error":"boom"}`
+	for _, cur := range []string{"", "{", stale, changed, failed} {
+		if !statusOutdated(cur, st, now) {
+			t.Errorf("Status %q should be outdated", cur)
+		}
+	}
+}
+
+func TestProcessItemForgetsOwner(t *testing.T) {
+	svc := newService("foo", map[string]string{namedPortMapAnnotation: `{"http": 8080}`})
+	conf := config.FakeConfig(svc)
+
+	wrk := &fakeWorker{owned: make(map[string][]string)}
+	c := NewController(conf, wrk)
+	c.startInformer()
+
+	if err := c.informer.GetStore().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processItem("default/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if names := wrk.owned["service/default/foo"]; len(names) != 1 || names[0] != "http" {
+		t.Fatalf("The service should own its ports: %v", wrk.owned)
+	}
+
+	// the named ports annotations are removed
+	if err := c.informer.GetStore().Update(newService("foo", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processItem("default/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := wrk.owned["service/default/foo"]; ok {
+		t.Errorf("The service owner should be forgotten: %v", wrk.owned)
+	}
+}
+
+func TestControllerDelete(t *testing.T) {
+	conf := config.FakeConfig(newService("foo", map[string]string{namedPortMapAnnotation: `{"http": 8080}`}))
+
+	wrk := &fakeWorker{owned: make(map[string][]string)}
+	c := NewController(conf, wrk)
+	c.startInformer()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		t.Fatal("Timed out waiting for caches to sync")
+	}
+
+	c.processNextItem()
+	if names := wrk.owned["service/default/foo"]; len(names) != 1 || names[0] != "http" {
+		t.Fatalf("The service should own its ports: %v", wrk.owned)
+	}
+
+	if err := conf.ClientSet.CoreV1().Services("default").Delete("foo", &meta_v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deletion is queued, and processed like other events
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return c.queue.Len() > 0, nil
+	})
+	if err != nil {
+		t.Fatal("The service deletion wasn't queued")
+	}
+	c.processNextItem()
+	if _, ok := wrk.owned["service/default/foo"]; ok {
+		t.Errorf("The deleted service owner should be forgotten: %v", wrk.owned)
+	}
+	if c.queue.NumRequeues("default/foo") != 0 {
+		t.Error("The deleted service shouldn't be retried")
+	}
+}
+
+func TestServiceClaims(t *testing.T) {
+	svc := newService("foo", map[string]string{
+		namedPortMapAnnotation:  `{"http": 8080, "https": 8443}`,
+		nodePoolsAnnotation:     "pool-a",
+		"kube-named-ports.io/x": "unknown",
+	})
+
+	claims, err := ServiceClaims(svc)
+	if err != nil {
+		t.Fatalf("ServiceClaims failed: %v", err)
+	}
+	if len(claims) != 2 || claims[0].Name != "http" || claims[1].Owner != "service/default/foo" {
+		t.Errorf("Unexpected claims: %v", claims)
+	}
+	if len(claims[0].Target.NodePools) != 1 {
+		t.Errorf("Claims lack port target: %v", claims)
+	}
+
+	if errs := CheckAnnotations(svc); len(errs) != 1 {
+		t.Errorf("Expected an unknown annotation error, got %v", errs)
+	}
+
+	svc = newService("foo", map[string]string{namedPortNameAnnotation: "http"})
+	if errs := CheckAnnotations(svc); len(errs) != 1 {
+		t.Errorf("Expected an incomplete annotations error, got %v", errs)
+	}
+
+	svc = newService("foo", map[string]string{namedPortMapAnnotation: `{"Not_Valid": 80}`})
+	if _, err = ServiceClaims(svc); err == nil {
+		t.Error("ServiceClaims should fail on invalid port name")
+	}
+}
@@ -0,0 +1,217 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// otlpExporter sends spans as OTLP/HTTP json requests to a collector's url.
+// The official otlptracehttp exporter needs google.golang.org/grpc and
+// google.golang.org/api releases more recent than the ones we're pinned to.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+// newCollectorExporter posts spans to an OTLP/HTTP collector url (checked by CheckEndpoint)
+func newCollectorExporter(endpoint string) *otlpExporter {
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + tracesPath,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ExportSpans implements sdktrace.SpanExporter
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %v", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export spans: %s returned %s", e.url, resp.Status)
+	}
+
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// OTLP json encoding (see opentelemetry-proto's trace/v1/trace.proto).
+// Ids are hex encoded, and 64 bits integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// OTLP status codes differ from the otel api's
+var otlpStatusCodes = map[codes.Code]int{
+	codes.Unset: 0,
+	codes.Ok:    1,
+	codes.Error: 2,
+}
+
+// encodeSpans groups the spans by instrumentation scope. All our spans
+// come from the same tracer provider, hence share the same resource.
+func encodeSpans(spans []sdktrace.ReadOnlySpan) *otlpRequest {
+	rs := otlpResourceSpans{}
+	if res := spans[0].Resource(); res != nil {
+		rs.Resource.Attributes = encodeAttributes(res.Attributes())
+	}
+
+	scopes := make(map[string]int)
+	for _, span := range spans {
+		scope := span.InstrumentationScope()
+		idx, ok := scopes[scope.Name]
+		if !ok {
+			idx = len(rs.ScopeSpans)
+			scopes[scope.Name] = idx
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{Scope: otlpScope{Name: scope.Name, Version: scope.Version}})
+		}
+		rs.ScopeSpans[idx].Spans = append(rs.ScopeSpans[idx].Spans, encodeSpan(span))
+	}
+
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func encodeSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	out := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: unixNano(span.StartTime()),
+		EndTimeUnixNano:   unixNano(span.EndTime()),
+		Attributes:        encodeAttributes(span.Attributes()),
+		Status: otlpStatus{
+			Code:    otlpStatusCodes[span.Status().Code],
+			Message: span.Status().Description,
+		},
+	}
+
+	if span.Parent().HasSpanID() {
+		out.ParentSpanID = span.Parent().SpanID().String()
+	}
+
+	for _, event := range span.Events() {
+		out.Events = append(out.Events, otlpEvent{
+			TimeUnixNano: unixNano(event.Time),
+			Name:         event.Name,
+			Attributes:   encodeAttributes(event.Attributes),
+		})
+	}
+
+	return out
+}
+
+func encodeAttributes(attrs []attribute.KeyValue) []otlpAttribute {
+	var out []otlpAttribute
+	for _, kv := range attrs {
+		var val otlpValue
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			b := kv.Value.AsBool()
+			val.BoolValue = &b
+		case attribute.INT64:
+			i := strconv.FormatInt(kv.Value.AsInt64(), 10)
+			val.IntValue = &i
+		case attribute.FLOAT64:
+			f := kv.Value.AsFloat64()
+			val.DoubleValue = &f
+		default:
+			s := kv.Value.Emit()
+			val.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: string(kv.Key), Value: val})
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
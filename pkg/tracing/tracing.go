@@ -0,0 +1,98 @@
+// Package tracing exports OpenTelemetry spans around resyncs and GCP API calls.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "kube-named-ports"
+
+	// instrumentationName identifies our spans
+	instrumentationName = "github.com/bpineau/kube-named-ports"
+
+	// tracesPath is the OTLP/HTTP traces endpoint path
+	tracesPath = "/v1/traces"
+)
+
+// CheckEndpoint validates a traces endpoint: empty (tracing disabled), "stdout",
+// or an http:// or https:// OTLP/HTTP collector url.
+func CheckEndpoint(endpoint string) error {
+	if endpoint == "" || endpoint == "stdout" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid traces endpoint %q: %v", endpoint, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid traces endpoint %q (should be stdout, or an http:// or https:// collector url)", endpoint)
+	}
+
+	return nil
+}
+
+// Init sets up the global tracer provider, exporting spans to the endpoint
+// (see CheckEndpoint). The returned function flushes pending spans and stops
+// the exports. Without endpoint, spans are no-ops.
+func Init(endpoint string) (func(context.Context) error, error) {
+	if err := CheckEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// "stdout" spans go to stderr, so they don't mix with commands' (ie. json) output
+	var exp sdktrace.SpanExporter = newCollectorExporter(endpoint)
+	if endpoint == "stdout" {
+		var err error
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create traces exporter: %v", err)
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, as a child of the context's span if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartClient starts a span around a GCP API call
+func StartClient(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// End records the error (if any) on the span, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
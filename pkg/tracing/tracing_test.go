@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestCheckEndpoint(t *testing.T) {
+	valid := []string{"", "stdout", "http://localhost:4318", "https://collector.example.com/"}
+	for _, endpoint := range valid {
+		if err := CheckEndpoint(endpoint); err != nil {
+			t.Errorf("CheckEndpoint(%q) should succeed: %v", endpoint, err)
+		}
+	}
+
+	invalid := []string{"stderr", "localhost:4318", "grpc://localhost:4317", "http://", "http://%zz"}
+	for _, endpoint := range invalid {
+		if err := CheckEndpoint(endpoint); err == nil {
+			t.Errorf("CheckEndpoint(%q) should fail", endpoint)
+		}
+	}
+}
+
+// stdoutSpan holds the stdouttrace output fields we check
+type stdoutSpan struct {
+	Name   string
+	Parent struct {
+		SpanID string
+	}
+	Status struct {
+		Code        string
+		Description string
+	}
+	Events     []struct{ Name string }
+	Attributes []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+}
+
+func TestExportStdout(t *testing.T) {
+	buf := new(bytes.Buffer)
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	tracer := provider.Tracer(instrumentationName)
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(attribute.String("zone", "europe-west1-b"), attribute.Int64("port", 8080))
+	End(child, errors.New("quota exceeded"))
+	End(parent, nil)
+
+	dec := json.NewDecoder(buf)
+	var span stdoutSpan
+	if err = dec.Decode(&span); err != nil {
+		t.Fatalf("invalid stdout exporter json: %v", err)
+	}
+
+	if span.Name != "child" || span.Parent.SpanID == "" {
+		t.Errorf("unexpected span name or parent: %+v", span)
+	}
+	if span.Status.Code != "Error" || span.Status.Description != "quota exceeded" || len(span.Events) != 1 {
+		t.Errorf("errors should be recorded on spans: %+v", span)
+	}
+	if len(span.Attributes) != 2 || span.Attributes[1].Key != "port" || span.Attributes[1].Value.Value != float64(8080) {
+		t.Errorf("unexpected span attributes: %+v", span.Attributes)
+	}
+
+	if err = dec.Decode(&span); err != nil || span.Name != "parent" {
+		t.Errorf("the parent span should be exported too: %+v, %v", span, err)
+	}
+}
+
+func TestInit(t *testing.T) {
+	shutdown, err := Init("")
+	if err != nil {
+		t.Fatalf("Init without endpoint failed: %v", err)
+	}
+	if err = shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+
+	if _, err = Init("grpc://localhost:4317"); err == nil {
+		t.Error("Init should fail on invalid endpoints")
+	}
+}
+
+func TestExportHTTP(t *testing.T) {
+	var paths []string
+	var spans int
+	status := http.StatusOK
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
+			spans += len(req.ResourceSpans[0].ScopeSpans[0].Spans)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	shutdown, err := Init(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	_, span := StartClient(context.Background(), "compute.instanceGroups.get")
+	End(span, nil)
+
+	if err = shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+	if spans != 1 || len(paths) != 1 || paths[0] != tracesPath {
+		t.Errorf("spans should be posted to %s, got %d spans on %v", tracesPath, spans, paths)
+	}
+
+	status = http.StatusServiceUnavailable
+	exp := newCollectorExporter(srv.URL)
+	provider := sdktrace.NewTracerProvider()
+	_, span = provider.Tracer(instrumentationName).Start(context.Background(), "failed")
+	span.End()
+	if err = exp.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span.(sdktrace.ReadOnlySpan)}); err == nil {
+		t.Error("ExportSpans should fail when the collector returns an error")
+	}
+}
@@ -2,13 +2,16 @@
 package worker
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/imdario/mergo"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/bpineau/kube-named-ports/config"
 	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+	"github.com/bpineau/kube-named-ports/pkg/tracing"
 )
 
 // Worker ensure the expected named ports are set on all node pools.
@@ -17,23 +20,61 @@ type Worker interface {
 	Stop()
 	Add(name string, port int64)
 	AddMap(ports np.PortList)
+	SetTarget(owner string, name string, target np.PortTarget)
+	SetOwnedPorts(owner string, names []string)
+	OnSync(handler SyncHandler)
+	Trigger()
 }
 
+// SyncHandler is called after each resync, with the resync outcome
+type SyncHandler func(status np.SyncStatus, err error)
+
 // PortMapper is worker synchronizing GCP named ports and services annotations
 type PortMapper struct {
 	expectedLock sync.RWMutex
 	expected     np.PortList
-	stop         chan bool
+	targets      map[string]map[string]np.PortTarget
+	owned        map[string][]string
+	handlersLock sync.Mutex
+	handlers     []SyncHandler
+	stop         chan struct{}
+	startOnce    sync.Once
+	stopOnce     sync.Once
+	done         chan struct{}
+	trigger      chan struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
 	config       *config.KnpConfig
 }
 
 var syncDelay = 60 * time.Second
 
+// syncer applies the expected named ports on a cluster's instance groups
+type syncer interface {
+	ResyncNamedPorts(ctx context.Context, expected np.PortList, targets np.TargetList, owners np.OwnerList) (np.SyncStatus, error)
+}
+
+// newSyncer returns a cluster's syncer (overridden by tests)
+var newSyncer = func(ctx context.Context, conf *config.KnpConfig) (syncer, error) {
+	namer, err := np.NewNamedPort(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	return namer, nil
+}
+
 // NewWorker returns a PortMapper worker
 func NewWorker(config *config.KnpConfig) *PortMapper {
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &PortMapper{
 		expected: make(np.PortList),
-		stop:     make(chan bool),
+		targets:  make(map[string]map[string]np.PortTarget),
+		owned:    make(map[string][]string),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		trigger:  make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
 		config:   config,
 	}
 	return p
@@ -41,12 +82,32 @@ func NewWorker(config *config.KnpConfig) *PortMapper {
 
 // Start launchs the PortMapper worker
 func (p *PortMapper) Start() {
-	go p.syncNamedPorts()
+	p.startOnce.Do(func() { go p.syncNamedPorts() })
 }
 
-// Stop stops the PortMapper worker
+// Stop stops the PortMapper worker. An ongoing resync is given the configured
+// shutdown grace period to complete, then is cancelled. Stop returns once the
+// worker is done.
 func (p *PortMapper) Stop() {
-	p.stop <- true
+	p.stopOnce.Do(func() { close(p.stop) })
+	defer p.cancel()
+
+	// a worker that was never started is done already
+	p.startOnce.Do(func() { close(p.done) })
+
+	grace := time.NewTimer(p.config.ShutdownGrace)
+	defer grace.Stop()
+
+	select {
+	case <-p.done:
+		return
+	case <-grace.C:
+	}
+
+	p.config.Logger.Warningf("Named ports resync for cluster %s still running after %v, cancelling it",
+		p.config.Cluster, p.config.ShutdownGrace)
+	p.cancel()
+	<-p.done
 }
 
 // Add declares a named port we want to keep in sync with GCP
@@ -65,30 +126,165 @@ func (p *PortMapper) AddMap(ports np.PortList) {
 	}
 }
 
+// SetTarget restricts a named port declared by an owner to some node pools.
+// A zero PortTarget means the owner expects the port on all node pools. Ports
+// are expected on the union of their owners targets.
+func (p *PortMapper) SetTarget(owner string, name string, target np.PortTarget) {
+	p.expectedLock.Lock()
+	defer p.expectedLock.Unlock()
+	if target.IsZero() {
+		delete(p.targets[owner], name)
+		return
+	}
+	if p.targets[owner] == nil {
+		p.targets[owner] = make(map[string]np.PortTarget)
+	}
+	p.targets[owner][name] = target
+}
+
+// SetOwnedPorts records the ports names declared by an owner object
+// (ie. "service/<namespace>/<name>"), for the changes audit records.
+// An empty list forgets the owner. Ports no longer declared by any owner
+// aren't expected anymore (but aren't removed from instance groups).
+func (p *PortMapper) SetOwnedPorts(owner string, names []string) {
+	p.expectedLock.Lock()
+	defer p.expectedLock.Unlock()
+
+	previous := p.owned[owner]
+	if len(names) == 0 {
+		delete(p.owned, owner)
+		delete(p.targets, owner)
+	} else {
+		p.owned[owner] = names
+	}
+
+	for _, name := range previous {
+		if !p.isOwned(name) {
+			delete(p.expected, name)
+		}
+		if !contains(names, name) {
+			delete(p.targets[owner], name)
+		}
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwned tells if a port is declared by an owner. Must be called with expectedLock held.
+func (p *PortMapper) isOwned(name string) bool {
+	for _, names := range p.owned {
+		if contains(names, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnSync registers a handler to be notified of resyncs outcomes
+func (p *PortMapper) OnSync(handler SyncHandler) {
+	p.handlersLock.Lock()
+	defer p.handlersLock.Unlock()
+	p.handlers = append(p.handlers, handler)
+}
+
+// Trigger requests an immediate resync. Requests made while a resync is
+// already pending are coalesced.
+func (p *PortMapper) Trigger() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (p *PortMapper) notify(status np.SyncStatus, err error) {
+	p.handlersLock.Lock()
+	handlers := make([]SyncHandler, len(p.handlers))
+	copy(handlers, p.handlers)
+	p.handlersLock.Unlock()
+
+	for _, handler := range handlers {
+		handler(status, err)
+	}
+}
+
 func (p *PortMapper) syncNamedPorts() {
-	namer := np.NewNamedPort(
-		p.config.Zone,
-		p.config.Cluster,
-		p.config.Project,
-		p.config.DryRun,
-		p.config.Logger)
-	portscopy := np.PortList{}
+	defer close(p.done)
+
+	var namer syncer
 
 	for {
 		select {
 		case <-time.After(syncDelay):
-			p.expectedLock.RLock()
-			for k, v := range p.expected {
-				portscopy[k] = v
-			}
-			p.expectedLock.RUnlock()
-
-			err := namer.ResyncNamedPorts(portscopy)
-			if err != nil {
-				p.config.Logger.Errorf("Error during ports resync: %v", err)
-			}
+			namer = p.resync(namer)
+		case <-p.trigger:
+			p.config.Logger.Infof("Immediate named ports resync requested for cluster %s", p.config.Cluster)
+			namer = p.resync(namer)
 		case <-p.stop:
 			return
 		}
 	}
 }
+
+// snapshot copies the expected ports, and computes their targets and owners
+func (p *PortMapper) snapshot() (np.PortList, np.TargetList, np.OwnerList) {
+	p.expectedLock.RLock()
+	defer p.expectedLock.RUnlock()
+
+	ports := np.PortList{}
+	for k, v := range p.expected {
+		ports[k] = v
+	}
+
+	var claims []np.Claim
+	for owner, names := range p.owned {
+		for _, name := range names {
+			claims = append(claims, np.Claim{Owner: owner, Name: name, Port: p.expected[name], Target: p.targets[owner][name]})
+		}
+	}
+	_, targets := np.FromClaims(claims)
+
+	return ports, targets, np.Owners(claims)
+}
+
+// resync applies the expected ports, and returns the (possibly newly created) namer
+func (p *PortMapper) resync(namer syncer) syncer {
+	var err error
+
+	ctx, span := tracing.Start(p.ctx, "worker.resync", attribute.String("cluster", p.config.Cluster))
+	defer func() { tracing.End(span, err) }()
+
+	// retry at each tick, so a broken cluster doesn't take others down
+	if namer == nil {
+		namer, err = newSyncer(p.ctx, p.config)
+		if err != nil {
+			p.config.Logger.Errorf("Failed to initialize named ports sync for cluster %s: %v", p.config.Cluster, err)
+			p.notify(np.SyncStatus{}, err)
+			return nil
+		}
+	}
+
+	// a distinct span, to tell waits on the expected ports lock apart
+	_, lspan := tracing.Start(ctx, "worker.snapshotExpected")
+	portscopy, targetscopy, owners := p.snapshot()
+	tracing.End(lspan, nil)
+
+	status, err := namer.ResyncNamedPorts(ctx, portscopy, targetscopy, owners)
+	if p.ctx.Err() != nil {
+		// cancelled on shutdown: don't report a partial outcome
+		p.config.Logger.Warningf("Named ports resync for cluster %s interrupted: %v", p.config.Cluster, err)
+		return namer
+	}
+	if err != nil {
+		p.config.Logger.Errorf("Error during ports resync for cluster %s: %v", p.config.Cluster, err)
+	}
+	p.notify(status, err)
+
+	return namer
+}
@@ -0,0 +1,186 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bpineau/kube-named-ports/config"
+	np "github.com/bpineau/kube-named-ports/pkg/namedports"
+)
+
+func TestStop(t *testing.T) {
+	conf := config.FakeConfig()
+	conf.ShutdownGrace = time.Minute
+
+	// stopping an idle worker shouldn't wait for the grace period
+	p := NewWorker(conf)
+	p.Start()
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() should return as soon as the worker is idle")
+	}
+
+	if p.ctx.Err() == nil {
+		t.Error("Stop() should cancel the worker's context")
+	}
+
+	// nor should a worker that was never started block
+	p = NewWorker(conf)
+	p.Stop()
+	p.Stop()
+}
+
+func TestSetOwnedPorts(t *testing.T) {
+	p := NewWorker(config.FakeConfig())
+
+	p.SetOwnedPorts("service/default/web", []string{"http", "https"})
+	p.AddMap(np.PortList{"http": 8080, "https": 8443})
+	p.SetOwnedPorts("namedport/http", []string{"http"})
+	p.Add("http", 8080)
+	p.SetTarget("service/default/web", "https", np.PortTarget{NodePools: []string{"pool-a"}})
+
+	// ie. the service's namespace is excluded: its ports are still declared elsewhere
+	p.SetOwnedPorts("service/default/web", nil)
+	if len(p.expected) != 1 || p.expected["http"] != 8080 {
+		t.Errorf("Only the ports without owners should be dropped: %v", p.expected)
+	}
+	if _, ok := p.targets["service/default/web"]; ok {
+		t.Errorf("Forgotten owners targets should be dropped: %v", p.targets)
+	}
+
+	p.SetOwnedPorts("namedport/http", nil)
+	if len(p.expected) != 0 || len(p.owned) != 0 {
+		t.Errorf("Ports without owners shouldn't be expected: %v, %v", p.expected, p.owned)
+	}
+}
+
+func TestTargetsUnion(t *testing.T) {
+	p := NewWorker(config.FakeConfig())
+	poolA := np.PortTarget{NodePools: []string{"pool-a"}}
+	poolB := np.PortTarget{NodePools: []string{"pool-b"}}
+
+	p.SetTarget("service/default/a", "http", poolA)
+	p.SetOwnedPorts("service/default/a", []string{"http"})
+	p.SetTarget("service/default/b", "http", poolB)
+	p.SetOwnedPorts("service/default/b", []string{"http"})
+	p.Add("http", 8080)
+
+	_, targets, owners := p.snapshot()
+	if len(targets["http"]) != 2 || len(owners["http"]) != 2 {
+		t.Errorf("The port should target both owners node pools: %v, %v", targets, owners)
+	}
+
+	// an owner without target expects the port everywhere, without
+	// forgetting the other owners targets
+	p.SetTarget("service/default/c", "http", np.PortTarget{})
+	p.SetOwnedPorts("service/default/c", []string{"http"})
+	if _, targets, _ = p.snapshot(); len(targets) != 0 {
+		t.Errorf("The port should target all node pools: %v", targets)
+	}
+
+	p.SetOwnedPorts("service/default/c", nil)
+	p.SetOwnedPorts("service/default/a", nil)
+	if _, targets, _ = p.snapshot(); len(targets["http"]) != 1 || targets["http"][0].NodePools[0] != "pool-b" {
+		t.Errorf("The remaining owner's target should apply: %v", targets)
+	}
+}
+
+// blockingSyncer blocks resyncs until released, or until their context is cancelled
+type blockingSyncer struct {
+	started  chan struct{}
+	release  chan struct{}
+	finished chan error
+}
+
+func (s *blockingSyncer) ResyncNamedPorts(ctx context.Context, expected np.PortList, targets np.TargetList,
+	owners np.OwnerList) (np.SyncStatus, error) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+	}
+	s.finished <- ctx.Err()
+	return np.SyncStatus{}, ctx.Err()
+}
+
+func startBlockingResync(t *testing.T, grace time.Duration) (*PortMapper, *blockingSyncer) {
+	s := &blockingSyncer{
+		started:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+		finished: make(chan error, 1),
+	}
+
+	defer func(orig func(context.Context, *config.KnpConfig) (syncer, error)) { newSyncer = orig }(newSyncer)
+	newSyncer = func(context.Context, *config.KnpConfig) (syncer, error) { return s, nil }
+
+	conf := config.FakeConfig()
+	conf.ShutdownGrace = grace
+
+	p := NewWorker(conf)
+	p.Start()
+	p.Trigger()
+
+	select {
+	case <-s.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The resync didn't start")
+	}
+
+	return p, s
+}
+
+func stopAsync(p *PortMapper) chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	return stopped
+}
+
+func TestStopWaitsForResync(t *testing.T) {
+	p, s := startBlockingResync(t, time.Minute)
+	stopped := stopAsync(p)
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop() should wait for the ongoing resync")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(s.release)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() should return once the resync completed")
+	}
+
+	if err := <-s.finished; err != nil {
+		t.Errorf("The resync shouldn't be cancelled within the grace period: %v", err)
+	}
+}
+
+func TestStopCancelsResync(t *testing.T) {
+	p, s := startBlockingResync(t, 50*time.Millisecond)
+	stopped := stopAsync(p)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() should cancel the resync once the grace period expired")
+	}
+
+	if err := <-s.finished; err != context.Canceled {
+		t.Errorf("The resync context should be cancelled, got: %v", err)
+	}
+}